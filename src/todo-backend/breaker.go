@@ -0,0 +1,382 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// CircuitBreakerTodoService stops calling a failing store. After failures
+// storage failures in a row (see storageFailure; a conflict or a not found
+// is the store working) it opens, failing every call with ErrCircuitOpen for
+// cooldown. It then lets one call through as a probe: if that succeeds it
+// closes again, otherwise it stays open for another cooldown.
+type CircuitBreakerTodoService struct {
+	svc      TodoService
+	failures int
+	cooldown time.Duration
+	Clock    Clock // Times the cooldown
+
+	m        sync.Mutex
+	state    breakerState
+	failed   int       // Failures in a row while closed
+	openedAt time.Time // When it last opened
+	probing  bool      // A half-open probe is in flight
+}
+
+// Breaker is the storage's circuit breaker, or nil when -breaker-failures is
+// 0. Set up in main.
+var Breaker *CircuitBreakerTodoService
+
+func NewCircuitBreakerTodoService(svc TodoService, failures int, cooldown time.Duration) *CircuitBreakerTodoService {
+	return &CircuitBreakerTodoService{svc: svc, failures: failures, cooldown: cooldown, Clock: systemClock{}}
+}
+
+// State returns "closed", "open" or "half-open".
+func (b *CircuitBreakerTodoService) State() string {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return b.state.String()
+}
+
+// rejecting reports whether calls would fail right now and, if so, how long
+// until it next lets a probe through.
+func (b *CircuitBreakerTodoService) rejecting() (bool, time.Duration) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if wait := b.cooldown - b.Clock.Now().Sub(b.openedAt); wait > 0 {
+			return true, wait
+		}
+	case breakerHalfOpen:
+		return b.probing, time.Second
+	}
+	return false, 0
+}
+
+// allow decides whether a call may go to storage, and whether it is the
+// probe whose result decides if the circuit closes.
+func (b *CircuitBreakerTodoService) allow() (probe bool, err error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if b.Clock.Now().Sub(b.openedAt) < b.cooldown {
+			return false, ErrCircuitOpen
+		}
+		b.state = breakerHalfOpen
+		fallthrough
+	case breakerHalfOpen:
+		if b.probing {
+			return false, ErrCircuitOpen
+		}
+		b.probing = true
+		return true, nil
+	}
+	return false, nil
+}
+
+// done records the outcome of a call allow let through, returning err.
+func (b *CircuitBreakerTodoService) done(probe bool, err error) error {
+	failed := storageFailure(err)
+	b.m.Lock()
+	defer b.m.Unlock()
+	switch {
+	case probe && failed:
+		b.probing = false
+		b.trip(err)
+	case probe:
+		b.probing = false
+		b.state = breakerClosed
+		b.failed = 0
+		log.Printf("storage circuit breaker closed")
+	case b.state != breakerClosed:
+		// Started before the circuit opened; only the probe counts now.
+	case failed:
+		b.failed++
+		if b.failed >= b.failures {
+			b.trip(err)
+		}
+	default:
+		b.failed = 0
+	}
+	return err
+}
+
+// trip opens the circuit. The caller must hold b.m.
+func (b *CircuitBreakerTodoService) trip(err error) {
+	b.state = breakerOpen
+	b.openedAt = b.Clock.Now()
+	b.failed = 0
+	log.Printf("storage circuit breaker open for %v after: %v", b.cooldown, err)
+}
+
+// failFastWhenOpen answers requests with a 503 while the circuit breaker is
+// rejecting calls, rather than have each handler fail its storage call.
+// Health checks still run so they can report the breaker.
+func failFastWhenOpen(next http.Handler) http.Handler {
+	if Breaker == nil {
+		return next
+	}
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if open, wait := Breaker.rejecting(); open && !isHealthCheck(r) {
+			w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds()+0.999)))
+			writeError(w, r, "Storage is unavailable, try again shortly", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+func (b *CircuitBreakerTodoService) GetAll() ([]*Todo, error) {
+	probe, err := b.allow()
+	if err != nil {
+		return nil, err
+	}
+	todos, err := b.svc.GetAll()
+	return todos, b.done(probe, err)
+}
+
+func (b *CircuitBreakerTodoService) Get(id int) (*Todo, error) {
+	probe, err := b.allow()
+	if err != nil {
+		return nil, err
+	}
+	todo, err := b.svc.Get(id)
+	return todo, b.done(probe, err)
+}
+
+func (b *CircuitBreakerTodoService) GetMany(ids []int) ([]*Todo, error) {
+	probe, err := b.allow()
+	if err != nil {
+		return nil, err
+	}
+	todos, err := b.svc.GetMany(ids)
+	return todos, b.done(probe, err)
+}
+
+func (b *CircuitBreakerTodoService) GetByTag(tag string) ([]*Todo, error) {
+	probe, err := b.allow()
+	if err != nil {
+		return nil, err
+	}
+	todos, err := b.svc.GetByTag(tag)
+	return todos, b.done(probe, err)
+}
+
+func (b *CircuitBreakerTodoService) GetChangedSince(since time.Time) ([]*Todo, error) {
+	probe, err := b.allow()
+	if err != nil {
+		return nil, err
+	}
+	todos, err := b.svc.GetChangedSince(since)
+	return todos, b.done(probe, err)
+}
+
+func (b *CircuitBreakerTodoService) GetChangedAfterSeq(seq int64) ([]*Todo, error) {
+	probe, err := b.allow()
+	if err != nil {
+		return nil, err
+	}
+	todos, err := b.svc.GetChangedAfterSeq(seq)
+	return todos, b.done(probe, err)
+}
+
+func (b *CircuitBreakerTodoService) Snapshot() ([]*Todo, error) {
+	probe, err := b.allow()
+	if err != nil {
+		return nil, err
+	}
+	todos, err := b.svc.Snapshot()
+	return todos, b.done(probe, err)
+}
+
+func (b *CircuitBreakerTodoService) CollectionVersion() (uint64, error) {
+	probe, err := b.allow()
+	if err != nil {
+		return 0, err
+	}
+	version, err := b.svc.CollectionVersion()
+	return version, b.done(probe, err)
+}
+
+func (b *CircuitBreakerTodoService) Count() (int, error) {
+	probe, err := b.allow()
+	if err != nil {
+		return 0, err
+	}
+	n, err := b.svc.Count()
+	return n, b.done(probe, err)
+}
+
+func (b *CircuitBreakerTodoService) ExistsByTitle(title string, except int) (bool, error) {
+	probe, err := b.allow()
+	if err != nil {
+		return false, err
+	}
+	exists, err := b.svc.ExistsByTitle(title, except)
+	return exists, b.done(probe, err)
+}
+
+func (b *CircuitBreakerTodoService) Stats() (TodoStats, error) {
+	probe, err := b.allow()
+	if err != nil {
+		return TodoStats{}, err
+	}
+	stats, err := b.svc.Stats()
+	return stats, b.done(probe, err)
+}
+
+func (b *CircuitBreakerTodoService) TagCounts() ([]TagCount, error) {
+	probe, err := b.allow()
+	if err != nil {
+		return nil, err
+	}
+	tags, err := b.svc.TagCounts()
+	return tags, b.done(probe, err)
+}
+
+func (b *CircuitBreakerTodoService) TagSummaries() ([]TagSummary, error) {
+	probe, err := b.allow()
+	if err != nil {
+		return nil, err
+	}
+	summaries, err := b.svc.TagSummaries()
+	return summaries, b.done(probe, err)
+}
+
+func (b *CircuitBreakerTodoService) Purge(before time.Time) (int, error) {
+	probe, err := b.allow()
+	if err != nil {
+		return 0, err
+	}
+	n, err := b.svc.Purge(before)
+	return n, b.done(probe, err)
+}
+
+func (b *CircuitBreakerTodoService) Subtasks(id int) ([]*Todo, error) {
+	probe, err := b.allow()
+	if err != nil {
+		return nil, err
+	}
+	todos, err := b.svc.Subtasks(id)
+	return todos, b.done(probe, err)
+}
+
+func (b *CircuitBreakerTodoService) History(id, offset, limit int) ([]*Todo, int, error) {
+	probe, err := b.allow()
+	if err != nil {
+		return nil, 0, err
+	}
+	versions, total, err := b.svc.History(id, offset, limit)
+	return versions, total, b.done(probe, err)
+}
+
+func (b *CircuitBreakerTodoService) Save(todo *Todo) error {
+	probe, err := b.allow()
+	if err != nil {
+		return err
+	}
+	return b.done(probe, b.svc.Save(todo))
+}
+
+func (b *CircuitBreakerTodoService) Create(todo *Todo) error {
+	probe, err := b.allow()
+	if err != nil {
+		return err
+	}
+	return b.done(probe, b.svc.Create(todo))
+}
+
+func (b *CircuitBreakerTodoService) Upsert(todo *Todo) (bool, error) {
+	probe, err := b.allow()
+	if err != nil {
+		return false, err
+	}
+	created, err := b.svc.Upsert(todo)
+	return created, b.done(probe, err)
+}
+
+func (b *CircuitBreakerTodoService) ArchiveCompleted() (int, error) {
+	probe, err := b.allow()
+	if err != nil {
+		return 0, err
+	}
+	n, err := b.svc.ArchiveCompleted()
+	return n, b.done(probe, err)
+}
+
+func (b *CircuitBreakerTodoService) Reorder(ids []int, complete bool) ([]*Todo, error) {
+	probe, err := b.allow()
+	if err != nil {
+		return nil, err
+	}
+	todos, err := b.svc.Reorder(ids, complete)
+	return todos, b.done(probe, err)
+}
+
+func (b *CircuitBreakerTodoService) Move(id, anchor int, after bool) (*Todo, bool, error) {
+	probe, err := b.allow()
+	if err != nil {
+		return nil, false, err
+	}
+	todo, moved, err := b.svc.Move(id, anchor, after)
+	return todo, moved, b.done(probe, err)
+}
+
+func (b *CircuitBreakerTodoService) RenormalizeOrder(minGap float64) (bool, error) {
+	probe, err := b.allow()
+	if err != nil {
+		return false, err
+	}
+	changed, err := b.svc.RenormalizeOrder(minGap)
+	return changed, b.done(probe, err)
+}
+
+func (b *CircuitBreakerTodoService) DeleteAll() error {
+	probe, err := b.allow()
+	if err != nil {
+		return err
+	}
+	return b.done(probe, b.svc.DeleteAll())
+}
+
+func (b *CircuitBreakerTodoService) DeleteWhere(filter TodoFilter) (int, error) {
+	probe, err := b.allow()
+	if err != nil {
+		return 0, err
+	}
+	n, err := b.svc.DeleteWhere(filter)
+	return n, b.done(probe, err)
+}
+
+func (b *CircuitBreakerTodoService) Delete(id int) error {
+	probe, err := b.allow()
+	if err != nil {
+		return err
+	}
+	return b.done(probe, b.svc.Delete(id))
+}
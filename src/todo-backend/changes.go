@@ -0,0 +1,187 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// changeFeed numbers changes to the todo collection and wakes anyone waiting
+// for the next one.
+type changeFeed struct {
+	m       sync.Mutex
+	version uint64
+	changed chan struct{} // Closed and replaced on every change
+}
+
+func newChangeFeed() *changeFeed {
+	return &changeFeed{changed: make(chan struct{})}
+}
+
+func (f *changeFeed) publish() {
+	f.m.Lock()
+	f.version++
+	close(f.changed)
+	f.changed = make(chan struct{})
+	f.m.Unlock()
+}
+
+// current returns the collection version and a channel closed when it next
+// changes.
+func (f *changeFeed) current() (uint64, <-chan struct{}) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return f.version, f.changed
+}
+
+// collectionETag formats a collection version (see
+// TodoService.CollectionVersion) as a weak ETag.
+func collectionETag(version uint64) string {
+	return `W/"` + strconv.FormatUint(version, 10) + `"`
+}
+
+// todoETag is a todo's ETag, made from its id and version so it changes on
+// every save without hashing the todo. It is strong so If-Match can use it.
+func todoETag(todo *Todo) string {
+	return `"` + encodeId(todo.Id) + "." + strconv.Itoa(todo.Version) + `"`
+}
+
+// setTodoETag sends todo's ETag, readable by cross-origin clients.
+func setTodoETag(w http.ResponseWriter, todo *Todo) {
+	w.Header().Set("ETag", todoETag(todo))
+	w.Header().Add("Access-Control-Expose-Headers", "ETag")
+}
+
+// ifMatch reports whether the request's If-Match precondition, if any,
+// holds for the stored todo, which is nil when there is none. Matching is
+// strong, so a weak ETag never matches.
+func ifMatch(r *http.Request, stored *Todo) bool {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return true
+	}
+	if stored == nil {
+		return false
+	}
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		if strings.TrimSpace(candidate) == todoETag(stored) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameETag compares ETags, ignoring weakness and accepting them unquoted as
+// they may arrive in a query parameter.
+func sameETag(a, b string) bool {
+	trim := func(s string) string {
+		return strings.Trim(strings.TrimPrefix(strings.TrimSpace(s), "W/"), `"`)
+	}
+	return trim(a) == trim(b)
+}
+
+// matchesETag reports whether an If-None-Match header, which may list several
+// ETags or be *, matches etag.
+func matchesETag(header, etag string) bool {
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		if sameETag(candidate, etag) {
+			return true
+		}
+	}
+	return false
+}
+
+var Changes = newChangeFeed()
+
+// notifyingTodoService publishes to a changeFeed after every successful write.
+type notifyingTodoService struct {
+	TodoService
+	feed *changeFeed
+}
+
+func (t *notifyingTodoService) Save(todo *Todo) error {
+	err := t.TodoService.Save(todo)
+	if err == nil {
+		t.feed.publish()
+	}
+	return err
+}
+
+func (t *notifyingTodoService) Create(todo *Todo) error {
+	err := t.TodoService.Create(todo)
+	if err == nil {
+		t.feed.publish()
+	}
+	return err
+}
+
+func (t *notifyingTodoService) Upsert(todo *Todo) (bool, error) {
+	created, err := t.TodoService.Upsert(todo)
+	if err == nil {
+		t.feed.publish()
+	}
+	return created, err
+}
+
+func (t *notifyingTodoService) RenormalizeOrder(minGap float64) (bool, error) {
+	changed, err := t.TodoService.RenormalizeOrder(minGap)
+	if err == nil && changed {
+		t.feed.publish()
+	}
+	return changed, err
+}
+
+func (t *notifyingTodoService) Reorder(ids []int, complete bool) ([]*Todo, error) {
+	todos, err := t.TodoService.Reorder(ids, complete)
+	if err == nil {
+		t.feed.publish()
+	}
+	return todos, err
+}
+
+func (t *notifyingTodoService) DeleteAll() error {
+	err := t.TodoService.DeleteAll()
+	if err == nil {
+		t.feed.publish()
+	}
+	return err
+}
+
+func (t *notifyingTodoService) ArchiveCompleted() (int, error) {
+	n, err := t.TodoService.ArchiveCompleted()
+	if err == nil && n > 0 {
+		t.feed.publish()
+	}
+	return n, err
+}
+
+func (t *notifyingTodoService) Move(id, anchor int, after bool) (*Todo, bool, error) {
+	todo, moved, err := t.TodoService.Move(id, anchor, after)
+	if err == nil && moved {
+		t.feed.publish()
+	}
+	return todo, moved, err
+}
+
+func (t *notifyingTodoService) DeleteWhere(filter TodoFilter) (int, error) {
+	n, err := t.TodoService.DeleteWhere(filter)
+	if err == nil && n > 0 {
+		t.feed.publish()
+	}
+	return n, err
+}
+
+func (t *notifyingTodoService) Delete(id int) error {
+	err := t.TodoService.Delete(id)
+	if err == nil {
+		t.feed.publish()
+	}
+	return err
+}
@@ -0,0 +1,20 @@
+package main
+
+import "time"
+
+// Clock tells the time. Timestamps on todos, and features that depend on
+// the time of day rather than on how long something takes, read it instead
+// of calling time.Now, so that tests can fix or advance it.
+type Clock interface {
+	Now() time.Time
+}
+
+// systemClock is the real clock.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// clock is the Clock the server runs on.
+var clock Clock = systemClock{}
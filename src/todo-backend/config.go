@@ -0,0 +1,305 @@
+package main
+
+import (
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// socketPerm is -socket-mode parsed.
+var socketPerm os.FileMode
+
+// Settings can be given as flags or in the environment, using the flag name
+// upper-cased with dashes replaced by underscores (gzip-level -> GZIP_LEVEL).
+var (
+	listenAddr    = flag.String("addr", "", `address to listen on, e.g. ":8080" or "unix:/run/todos.sock"; defaults to ":$PORT"`)
+	socketMode    = flag.String("socket-mode", "0660", "permissions, in octal, of the Unix socket -addr=unix:<path> creates")
+	publicUrl     = flag.String("public-url", "", "scheme and host todo urls start with, e.g. https://todos.example.com, instead of the request's Host")
+	canonicalHost = flag.String("canonical-host", "", "host[:port] requests must use; requests for any other Host are redirected there with a 308")
+	h2c           = flag.Bool("h2c", false, "also accept HTTP/2 without TLS (h2c), e.g. behind a proxy")
+	gzipLevel     = flag.Int("gzip-level", gzip.DefaultCompression, "gzip compression level for responses: 1-9, or -1 for the default")
+	basePath      = flag.String("base-path", "", "public path prefix the API is served under, e.g. /api")
+	corsMaxAge    = flag.Duration("cors-max-age", 10*time.Minute, "how long browsers may cache a CORS preflight response")
+	showUrls      = flag.Bool("urls", true, "include each todo's url in responses; ?urls= overrides this per request")
+	idType        = flag.String("id-type", "int", `how todo ids appear in urls and bodies: "int", or "uuid"`)
+	idSalt        = flag.String("id-salt", "", "if set, shuffle ids with this secret so sequential ones can't be guessed; int ids become opaque tokens")
+
+	maxInFlight       = flag.Int("max-in-flight", 0, "most requests handled at once before shedding load with 503s; 0 is unlimited")
+	maxClientInFlight = flag.Int("max-client-in-flight", 0, "most requests one client IP may have in flight before getting 429s; 0 is unlimited")
+	queueTimeout      = flag.Duration("queue-timeout", 0, "how long a request over -max-in-flight waits for a slot; 0 rejects it at once")
+
+	sortFields   = flag.String("sortable-fields", "order,title,completed,dueDate,updatedAt", "comma-separated fields clients may sort GET /todos by with ?sort=")
+	filterFields = flag.String("filterable-fields", "completed,tag,archived,meta", "comma-separated fields clients may filter todos by")
+	sortDirs     = flag.String("sort-directions", "updatedAt:desc", "comma-separated field:asc or field:desc directions ?sort= uses for fields given without a - or + prefix; others sort ascending")
+	sortDefault  = flag.String("default-sort", "", "sort, as ?sort= takes it, for lists requested without one, such as order,id; empty keeps the store's order")
+
+	maxIds      = flag.Int("max-ids", 100, "most ids a client may ask for at once with GET /todos?ids=")
+	maxPageSize = flag.Int("max-page-size", 100, "most items a page holds: larger ?limit= values and Range: items= requests get this many")
+	maxWait     = flag.Duration("max-wait", time.Minute, "longest a client may long-poll GET /todos with ?wait=")
+
+	maxBodySize      = flag.Int64("max-body-size", 1<<20, "largest request body accepted, in bytes, after any decompression")
+	maxImportSize    = flag.Int64("max-import-size", 1<<30, "largest body POST /import accepts, in bytes, after any decompression")
+	importBatchSize  = flag.Int("import-batch-size", 500, "how many todos POST /import saves at a time, and rolls back if one fails")
+	maxTitleLength   = flag.Int("max-title-length", 512, "longest todo title accepted, in characters")
+	maxNotesLength   = flag.Int("max-notes-length", 10000, "longest todo notes accepted, in characters")
+	maxMetaSize      = flag.Int("max-meta-size", 4096, "largest todo meta object accepted, in bytes as compact JSON")
+	checkModeList    = flag.String("check-modes", "", "comma-separated check:mode overrides of what a todo failing a check gets, mode being reject, warn or ignore; checks are title-length, notes-length, meta-size (rejected by default) and past-due (ignored)")
+	defaultCompleted = flag.Bool("default-completed", false, "whether a todo created by POST or PUT without \"completed\" starts completed")
+	fieldDefaults    = flag.String("field-defaults", "", `JSON object of defaults for fields a new todo leaves out, e.g. {"tags": ["inbox"]}`)
+	uniqueTitles     = flag.Bool("unique-titles", false, "reject a todo with 409 if another has the same title, ignoring case")
+
+	indexPage          = flag.Bool("index-page", true, "serve a page at / listing the API's endpoints")
+	enablePprof        = flag.Bool("pprof", false, "serve Go profiling data under /debug/pprof/; anyone who can reach the server can read it")
+	debugEchoToken     = flag.String("debug-echo-token", "", "if set, serve /debug/echo, which shows a request as the server received it, to clients giving this as a bearer token or X-API-Key")
+	serverTimingHeader = flag.Bool("server-timing", false, "report storage and total time in a Server-Timing response header")
+
+	problemJson    = flag.Bool("problem-json", false, "send errors as RFC 7807 application/problem+json")
+	envelopeMode   = flag.Bool("envelope", false, `wrap response bodies as {"data": ..., "meta": ...} and errors as {"errors": [...]}`)
+	validateSchema = flag.Bool("validate-schema", true, "check POST and PATCH bodies against the JSON Schemas in schema/")
+	deleteResponse = flag.Int("delete-response", http.StatusNoContent, "status a successful DELETE answers with: 204, or 200 with a JSON body describing what was deleted")
+
+	logSample       = flag.Int("log-sample", 1, "log one in this many requests; 0 logs only server errors")
+	logSlowerThan   = flag.Duration("log-slower-than", 0, "only log requests taking at least this long")
+	logNon2xxOnly   = flag.Bool("log-non-2xx-only", false, "only log requests that didn't succeed")
+	panicMode       = flag.String("panic-mode", "prod", `on a panic in a handler: "prod" logs it and answers 500, "dev" logs it and exits`)
+	securityLogPath = flag.String("security-log", "", `file to append requests answered 401, 403, 413 or 429 to as JSON lines, or "-" for stderr`)
+	logRedact       = flag.String("log-redact", "apikey,api_key,token,access_token,password", "comma-separated query parameters whose values are logged as ***")
+	requestIdHeader = flag.String("request-id-header", "X-Request-Id", "header carrying the request id, taken from the request when a proxy sets it and echoed in the response; empty disables request ids")
+
+	storage      = flag.String("storage", "memory", `storage backend: "memory", or "mirror:<primary>,<secondary>"`)
+	mirrorSample = flag.Float64("mirror-sample", 0.1, "fraction of reads a mirror storage compares against its secondary")
+	seed         = flag.String("seed", "", "JSON file of todos to load at startup when the store is empty")
+	seedForce    = flag.Bool("seed-force", false, "load the -seed file even if the store already has todos")
+	selftest     = flag.String("selftest", "", "instead of serving, run the Todo-Backend spec checks against the todos collection at this url, deleting its todos, and exit")
+
+	historyLimit   = flag.Int("history-limit", 50, "how many versions of each todo GET /todos/{id}/history keeps; 0 keeps none")
+	cascadeDeletes = flag.Bool("cascade-deletes", true, "deleting a todo also deletes its subtasks; when false, deleting a todo that has any is refused")
+	undoHistory    = flag.Int("undo-history", 20, "how many recent changes POST /todos/undo can revert; 0 disables it")
+
+	orderCheckInterval = flag.Duration("order-check-interval", time.Hour, "how often to renumber order values that have become too close; 0 disables")
+	purgeInterval      = flag.Duration("purge-interval", time.Hour, "how often to purge todos deleted longer ago than -purge-after; 0 disables")
+	purgeAfter         = flag.Duration("purge-after", 0, "how long deleted todos are kept, for ?since= syncs and restoring, before being purged for good; 0 keeps them forever")
+	orderMinGap        = flag.Float64("order-min-gap", 1e-6, "smallest gap between order values before they are renumbered")
+	reorderComplete    = flag.Bool("reorder-complete", false, "PUT /todos/order must list every todo GET /todos lists, rather than the ones left out following the listed ones")
+	orderMode          = flag.String("order-mode", string(OrderAllow), `what a write giving a todo another's order does: "allow" it, "reject" it with 409, or "shift" the others along`)
+
+	maintenanceMessage = flag.String("maintenance-notice", "", "notice about planned maintenance to send clients in an X-Maintenance header")
+	maintenanceFrom    = flag.String("maintenance-start", "", "RFC 3339 time the maintenance starts, sent with the notice")
+	maintenanceUntil   = flag.String("maintenance-end", "", "RFC 3339 time the maintenance ends, after which the notice is no longer sent")
+
+	startReadOnly = flag.Bool("read-only", false, "start refusing writes with 503s; SIGHUP toggles this while running")
+	shutdownDelay = flag.Duration("shutdown-delay", 0, "on SIGTERM, how long to keep serving with /readyz failing before draining, so load balancers stop routing here first")
+	drainTimeout  = flag.Duration("drain-timeout", 10*time.Second, "how long shutdown waits for long-polls and other requests to finish on SIGTERM")
+
+	breakerFailures = flag.Int("breaker-failures", 0, "storage failures in a row that open the circuit breaker, failing requests with 503s; 0 disables it")
+	breakerCooldown = flag.Duration("breaker-cooldown", 30*time.Second, "how long the circuit breaker stays open before letting a probe through")
+
+	eventsUrl     = flag.String("events-url", "", "where to publish todo changes: nats://[user:pass@]host:port, or an http(s) url to POST each one to")
+	eventsSubject = flag.String("events-subject", "todos.changes", "NATS subject -events-url publishes on")
+	eventsRetries = flag.Int("events-retries", 3, "how many more times to try publishing a change before dropping it")
+
+	startupTimeout     = flag.Duration("startup-timeout", time.Minute, "how long to retry storage at startup before exiting, for databases that start after the server; 0 doesn't check")
+	slowQueryThreshold = flag.Duration("slow-query-threshold", 0, "log a warning for storage calls taking longer than this; 0 turns it off")
+	healthTimeout      = flag.Duration("health-timeout", time.Second, "how long /healthz waits for storage before failing")
+	healthMaxLatency   = flag.Duration("health-max-latency", 500*time.Millisecond, "storage latency above which /healthz reports unhealthy")
+)
+
+func parseConfig() error {
+	flag.Parse()
+
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		if set[f.Name] || err != nil {
+			return
+		}
+		name := strings.ToUpper(strings.Replace(f.Name, "-", "_", -1))
+		if value, ok := os.LookupEnv(name); ok {
+			if serr := f.Value.Set(value); serr != nil {
+				err = fmt.Errorf("invalid $%s: %v", name, serr)
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	if *gzipLevel != gzip.DefaultCompression && (*gzipLevel < gzip.BestSpeed || *gzipLevel > gzip.BestCompression) {
+		return fmt.Errorf("invalid gzip level %d: must be 1-9 or -1", *gzipLevel)
+	}
+
+	mode, perr := strconv.ParseUint(*socketMode, 8, 32)
+	if perr != nil || mode > 0777 {
+		return fmt.Errorf("invalid socket mode %q: must be octal permissions such as 0660", *socketMode)
+	}
+	socketPerm = os.FileMode(mode)
+	if *publicUrl != "" {
+		u, perr := url.Parse(*publicUrl)
+		if perr != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || strings.Trim(u.Path, "/") != "" {
+			return fmt.Errorf("invalid public url %q: must be http(s)://host[:port] with no path; use -base-path for one", *publicUrl)
+		}
+		if *canonicalHost != "" && !strings.EqualFold(u.Host, *canonicalHost) {
+			return fmt.Errorf("invalid canonical host %q: must be the host of -public-url, %q", *canonicalHost, u.Host)
+		}
+	}
+	if strings.ContainsAny(*canonicalHost, "/?#@ ") {
+		return fmt.Errorf("invalid canonical host %q: must be host[:port]", *canonicalHost)
+	}
+
+	if todoIds, err = newIdCodec(*idType, *idSalt); err != nil {
+		return err
+	}
+
+	if *maxPageSize < 1 {
+		return fmt.Errorf("invalid max page size %d: must be at least 1", *maxPageSize)
+	}
+	if *maxIds < 1 {
+		return fmt.Errorf("invalid max ids %d: must be at least 1", *maxIds)
+	}
+
+	if *maxBodySize < 1 {
+		return fmt.Errorf("invalid max body size %d: must be at least 1", *maxBodySize)
+	}
+
+	if *maxImportSize < 1 {
+		return fmt.Errorf("invalid max import size %d: must be at least 1", *maxImportSize)
+	}
+	if *importBatchSize < 1 {
+		return fmt.Errorf("invalid import batch size %d: must be at least 1", *importBatchSize)
+	}
+
+	if *maxTitleLength < 1 {
+		return fmt.Errorf("invalid max title length %d: must be at least 1", *maxTitleLength)
+	}
+	if *maxNotesLength < 0 {
+		return fmt.Errorf("invalid max notes length %d: must not be negative", *maxNotesLength)
+	}
+	if *maxMetaSize < 0 {
+		return fmt.Errorf("invalid max meta size %d: must not be negative", *maxMetaSize)
+	}
+
+	if *deleteResponse != http.StatusNoContent && *deleteResponse != http.StatusOK {
+		return fmt.Errorf("invalid delete response %d: must be 204 or 200", *deleteResponse)
+	}
+
+	if *corsMaxAge < 0 {
+		return fmt.Errorf("invalid CORS max age %v: must not be negative", *corsMaxAge)
+	}
+	if *eventsRetries < 0 {
+		return fmt.Errorf("invalid events retries %d: must not be negative", *eventsRetries)
+	}
+	if *shutdownDelay < 0 {
+		return fmt.Errorf("invalid shutdown delay %v: must not be negative", *shutdownDelay)
+	}
+	if *drainTimeout < 0 {
+		return fmt.Errorf("invalid drain timeout %v: must not be negative", *drainTimeout)
+	}
+
+	if checkModes, err = parseCheckModes(*checkModeList); err != nil {
+		return fmt.Errorf("invalid check modes: %v", err)
+	}
+	if todoDefaults, err = parseFieldDefaults(*fieldDefaults, *defaultCompleted); err != nil {
+		return fmt.Errorf("invalid field defaults: %v", err)
+	}
+
+	if *problemJson && *envelopeMode {
+		return fmt.Errorf("-problem-json and -envelope can't both be set")
+	}
+
+	if *panicMode != "prod" && *panicMode != "dev" {
+		return fmt.Errorf("invalid panic mode %q: must be prod or dev", *panicMode)
+	}
+
+	if *logSample < 0 {
+		return fmt.Errorf("invalid log sample %d: must not be negative", *logSample)
+	}
+
+	if *historyLimit < 0 {
+		return fmt.Errorf("invalid history limit %d: must not be negative", *historyLimit)
+	}
+	if *undoHistory < 0 {
+		return fmt.Errorf("invalid undo history %d: must not be negative", *undoHistory)
+	}
+
+	if *mirrorSample < 0 || *mirrorSample > 1 {
+		return fmt.Errorf("invalid mirror sample %v: must be between 0 and 1", *mirrorSample)
+	}
+
+	if *purgeInterval < 0 || *purgeAfter < 0 {
+		return fmt.Errorf("invalid purge interval %v or retention %v: must not be negative", *purgeInterval, *purgeAfter)
+	}
+	if *orderMinGap <= 0 {
+		return fmt.Errorf("invalid order min gap %v: must be positive", *orderMinGap)
+	}
+
+	switch OrderMode(*orderMode) {
+	case OrderAllow, OrderReject, OrderShift:
+	default:
+		return fmt.Errorf("invalid order mode %q: must be allow, reject or shift", *orderMode)
+	}
+
+	if *breakerFailures < 0 {
+		return fmt.Errorf("invalid breaker failures %d: must not be negative", *breakerFailures)
+	}
+	if *breakerCooldown <= 0 {
+		return fmt.Errorf("invalid breaker cooldown %v: must be positive", *breakerCooldown)
+	}
+
+	if *slowQueryThreshold < 0 {
+		return fmt.Errorf("invalid slow query threshold %v: must not be negative", *slowQueryThreshold)
+	}
+	if *startupTimeout < 0 {
+		return fmt.Errorf("invalid startup timeout %v: must not be negative", *startupTimeout)
+	}
+	if *healthTimeout <= 0 {
+		return fmt.Errorf("invalid health timeout %v: must be positive", *healthTimeout)
+	}
+
+	if *maintenanceFrom != "" {
+		if maintenanceStart, err = time.Parse(time.RFC3339, *maintenanceFrom); err != nil {
+			return fmt.Errorf("invalid maintenance start: %v", err)
+		}
+	}
+	if *maintenanceUntil != "" {
+		if maintenanceEnd, err = time.Parse(time.RFC3339, *maintenanceUntil); err != nil {
+			return fmt.Errorf("invalid maintenance end: %v", err)
+		}
+	}
+
+	if sortableFields, err = parseFieldList(*sortFields, func(name string) bool { return todoOrderings[name] != nil }); err != nil {
+		return fmt.Errorf("invalid sortable fields: %v", err)
+	}
+	if descendingByDefault, err = parseSortDirections(*sortDirs); err != nil {
+		return fmt.Errorf("invalid sort directions: %v", err)
+	}
+	if *sortDefault != "" {
+		if defaultSort, err = parseSort(*sortDefault); err != nil {
+			return fmt.Errorf("invalid default sort: %v", err)
+		}
+	}
+	if filterableFields, err = parseFieldList(*filterFields, func(name string) bool { return slices.Contains(todoFilters, name) }); err != nil {
+		return fmt.Errorf("invalid filterable fields: %v", err)
+	}
+
+	redactedParams = make(map[string]bool)
+	for _, name := range strings.Split(*logRedact, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			redactedParams[strings.ToLower(name)] = true
+		}
+	}
+
+	*basePath = strings.TrimRight(*basePath, "/")
+	if *basePath != "" && !strings.HasPrefix(*basePath, "/") {
+		return fmt.Errorf("invalid base path %q: must start with /", *basePath)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"sync"
+)
+
+// dedupedTodoService shares one GetAll among concurrent callers, so a burst
+// of list requests costs a single backend read. A caller only joins a read
+// that started since the last change on feed, so it never misses a write
+// that had already completed. Each caller gets its own copy of the todos,
+// since handlers modify them (e.g. filling in Url).
+type dedupedTodoService struct {
+	TodoService
+	feed *changeFeed
+
+	m    sync.Mutex
+	call *getAllCall // The latest GetAll in progress, if any
+}
+
+type getAllCall struct {
+	version uint64
+	done    chan struct{}
+	todos   []*Todo
+	err     error
+}
+
+func (t *dedupedTodoService) GetAll() ([]*Todo, error) {
+	version, _ := t.feed.current()
+
+	t.m.Lock()
+	if c := t.call; c != nil && c.version == version {
+		t.m.Unlock()
+		<-c.done
+		return cloneTodos(c.todos), c.err
+	}
+	c := &getAllCall{version: version, done: make(chan struct{})}
+	t.call = c
+	t.m.Unlock()
+
+	defer func() {
+		t.m.Lock()
+		if t.call == c {
+			t.call = nil
+		}
+		t.m.Unlock()
+		close(c.done)
+	}()
+	c.todos, c.err = t.TodoService.GetAll()
+	return cloneTodos(c.todos), c.err
+}
+
+func cloneTodos(todos []*Todo) []*Todo {
+	if todos == nil {
+		return nil
+	}
+	clones := make([]*Todo, len(todos))
+	for i, todo := range todos {
+		clones[i] = todo.clone()
+	}
+	return clones
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// defaultableFields are the fields -field-defaults may set. The rest are
+// either required or kept by the store.
+var defaultableFields = []string{"notes", "completed", "order", "tags", "dueDate", "archived"}
+
+// todoDefaults is what a new todo starts as before its body is decoded over
+// it, so any field the body leaves out keeps its default. Set by parseConfig.
+var todoDefaults Todo
+
+// newTodo returns a todo with the deployment's defaults, for decoding a
+// create into.
+func newTodo() *Todo {
+	return todoDefaults.clone()
+}
+
+// parseFieldDefaults reads -field-defaults, a JSON object of field defaults,
+// checking them against the create schema and the limits. -default-completed
+// is folded in, and may not be combined with a "completed" default.
+func parseFieldDefaults(spec string, completed bool) (Todo, error) {
+	defaults := Todo{Completed: completed}
+	if strings.TrimSpace(spec) == "" {
+		return defaults, nil
+	}
+
+	var fields map[string]interface{}
+	d := json.NewDecoder(strings.NewReader(spec))
+	d.UseNumber()
+	if err := d.Decode(&fields); err != nil {
+		return defaults, fmt.Errorf("not a JSON object: %v", err)
+	}
+	for name := range fields {
+		if !slices.Contains(defaultableFields, name) {
+			return defaults, fmt.Errorf("%q can't have a default; only %s can", name, strings.Join(defaultableFields, ", "))
+		}
+	}
+	if _, ok := fields["completed"]; ok && completed {
+		return defaults, fmt.Errorf(`"completed" is also set by -default-completed`)
+	}
+
+	fields["title"] = "-" // Required by the schema but never defaulted
+	if violations := createTodoSchema.validate(fields); len(violations) > 0 {
+		return defaults, fmt.Errorf("%s", strings.Join(violations, "; "))
+	}
+	if err := json.NewDecoder(bytes.NewReader([]byte(spec))).Decode(&defaults); err != nil {
+		return defaults, err
+	}
+	if _, err := checkLimits(&defaults); err != nil {
+		return defaults, err
+	}
+	return defaults, nil
+}
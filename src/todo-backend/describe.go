@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// OPTIONS on /todos or /todos/{id} answers with a description of the
+// resource for API explorers that ask for one, with an X-Describe: true
+// header or by accepting JSON. CORS preflights, which carry
+// Access-Control-Request-Method, always get the bare headers.
+
+// resourceDescription is the body of a described OPTIONS.
+type resourceDescription struct {
+	Methods []string                   `json:"methods"`
+	Fields  map[string]string          `json:"fields"`   // Todo field to its JSON types, as "string|null"
+	Bodies  map[string]json.RawMessage `json:"requests"` // Method to the JSON Schema its body is checked against
+}
+
+// describedMethods are the methods of each resource and the schema file, if
+// any, their bodies are checked against.
+var describedMethods = map[string][]struct{ method, schema string }{
+	"/todos": {
+		{"GET", ""}, {"HEAD", ""}, {"POST", "schema/todo-create.json"}, {"DELETE", ""},
+	},
+	"/todos/{id}": {
+		{"GET", ""}, {"HEAD", ""}, {"PATCH", "schema/todo-update.json"}, {"PUT", "schema/todo-create.json"}, {"DELETE", ""},
+	},
+}
+
+// describedResource is the key of describedMethods for path, or "".
+func describedResource(path string) string {
+	if path == "/todos" || path == "/todos/" {
+		return "/todos"
+	}
+	key, ok := strings.CutPrefix(path, "/todos/")
+	if !ok || strings.Contains(key, "/") {
+		return ""
+	}
+	if _, err := decodeId(key); err != nil {
+		return "" // One of the fixed routes, such as /todos/stats
+	}
+	return "/todos/{id}"
+}
+
+// wantsDescription reports whether an OPTIONS request asks for the
+// resource to be described rather than being a preflight.
+func wantsDescription(r *http.Request) bool {
+	if r.Header.Get("Access-Control-Request-Method") != "" {
+		return false
+	}
+	if describe, err := strconv.ParseBool(r.Header.Get("X-Describe")); err == nil {
+		return describe
+	}
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(accepted)
+		if err == nil && (mediaType == "application/json" || mediaType == "application/schema+json") {
+			return true
+		}
+	}
+	return false
+}
+
+// describe answers an OPTIONS request for resource.
+func describe(w http.ResponseWriter, resource string) {
+	description := resourceDescription{
+		Fields: make(map[string]string, len(createTodoSchema.Properties)),
+		Bodies: make(map[string]json.RawMessage),
+	}
+	for name, property := range createTodoSchema.Properties {
+		description.Fields[name] = strings.Join(property.Type, "|")
+	}
+	for _, m := range describedMethods[resource] {
+		description.Methods = append(description.Methods, m.method)
+		if m.schema != "" {
+			b, _ := schemaFiles.ReadFile(m.schema) // Embedded, so it's there
+			description.Bodies[m.method] = b
+		}
+	}
+	w.Header().Set("Allow", strings.Join(description.Methods, ", "))
+	w.Header().Add("Vary", "X-Describe")
+	w.Header().Add("Vary", "Accept")
+	writeJson(w, description)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+// With -debug-echo-token, /debug/echo answers any request with what reached
+// the server, for finding what a proxy or CDN in front of it changed. It
+// needs the token as a bearer token or in X-API-Key, and never echoes
+// credentials back.
+
+// echoRedactedHeaders are the headers whose values are shown as ***.
+var echoRedactedHeaders = []string{"Authorization", "Proxy-Authorization", "X-Api-Key", "Cookie"}
+
+type echoReply struct {
+	Method     string              `json:"method"`
+	Uri        string              `json:"uri"` // With -log-redact parameters as ***
+	Proto      string              `json:"proto"`
+	Host       string              `json:"host"`
+	RemoteAddr string              `json:"remoteAddr"`
+	Headers    map[string][]string `json:"headers"`
+	Query      map[string][]string `json:"query"`
+	Body       string              `json:"body"`
+	// BodyEncoding is base64 when the body isn't UTF-8 text.
+	BodyEncoding string `json:"bodyEncoding,omitempty"`
+}
+
+// echoAuthorized reports whether the request carries -debug-echo-token.
+func echoAuthorized(r *http.Request) bool {
+	given := r.Header.Get("X-API-Key")
+	if auth := r.Header.Get("Authorization"); given == "" && auth != "" {
+		scheme, token, _ := strings.Cut(auth, " ")
+		if strings.EqualFold(scheme, "Bearer") {
+			given = strings.TrimSpace(token)
+		}
+	}
+	return given != "" && subtle.ConstantTimeCompare([]byte(given), []byte(*debugEchoToken)) == 1
+}
+
+func echoHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	if !echoAuthorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="debug"`)
+		writeError(w, r, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if maxErr := (*http.MaxBytesError)(nil); errors.As(err, &maxErr) {
+		writeError(w, r, fmt.Sprintf("request body is over the %d byte limit", maxErr.Limit), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	headers := r.Header.Clone()
+	for _, name := range echoRedactedHeaders {
+		for i := range headers[name] {
+			headers[name][i] = "***"
+		}
+	}
+	query := r.URL.Query()
+	for name, values := range query {
+		if redactedParams[strings.ToLower(name)] {
+			for i := range values {
+				values[i] = "***"
+			}
+		}
+	}
+	reply := echoReply{
+		Method:     r.Method,
+		Uri:        redactedURI(r.URL),
+		Proto:      r.Proto,
+		Host:       r.Host,
+		RemoteAddr: r.RemoteAddr,
+		Headers:    headers,
+		Query:      map[string][]string(query),
+		Body:       string(body),
+	}
+	if !utf8.Valid(body) {
+		reply.Body = base64.StdEncoding.EncodeToString(body)
+		reply.BodyEncoding = "base64"
+	}
+	writeJson(w, reply)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// With -envelope, response bodies are wrapped as {"data": ..., "meta": ...}
+// for frameworks that expect it, and errors are sent as {"errors": [...]}
+// after JSON:API. JSON-RPC responses have their own envelope and are left
+// alone.
+
+type envelope struct {
+	Data interface{}  `json:"data"`
+	Meta envelopeMeta `json:"meta,omitempty"`
+}
+
+// envelopeMeta describes the data in an envelope, such as the totals for a
+// list.
+type envelopeMeta map[string]interface{}
+
+type envelopeError struct {
+	Status string `json:"status"`
+	Title  string `json:"title"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// writeJson encodes v as the response body.
+func writeJson(w http.ResponseWriter, v interface{}) {
+	writeJsonMeta(w, v, nil)
+}
+
+// writeJsonMeta encodes v as the response body, with meta alongside it in
+// an envelope.
+func writeJsonMeta(w http.ResponseWriter, v interface{}, meta envelopeMeta) {
+	if *envelopeMode {
+		v = envelope{Data: v, Meta: meta}
+	}
+	json.NewEncoder(w).Encode(v)
+}
+
+// listMeta is the meta for a list of n items that is all there is.
+func listMeta(n int) envelopeMeta {
+	return envelopeMeta{"total": n}
+}
+
+// writeEnvelopeErrors sends an error as a list with the message first and
+// then each of its details, all with the same status.
+func writeEnvelopeErrors(w http.ResponseWriter, message string, code int, details []string) {
+	status, title := strconv.Itoa(code), http.StatusText(code)
+	errors := []envelopeError{{Status: status, Title: title, Detail: message}}
+	for _, detail := range details {
+		errors = append(errors, envelopeError{Status: status, Title: title, Detail: detail})
+	}
+	json.NewEncoder(w).Encode(struct {
+		Errors []envelopeError `json:"errors"`
+	}{errors})
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// The kinds of error handlers tell apart. The specific errors below wrap one
+// of them, so errors.Is(err, ErrConflict) holds for ErrVersionConflict, and
+// errorStatus maps each kind to its HTTP status in one place.
+var (
+	ErrMalformed   = errors.New("malformed request")
+	ErrNotFound    = errors.New("not found")
+	ErrConflict    = errors.New("conflict")
+	ErrValidation  = errors.New("invalid")
+	ErrReadOnly    = errors.New("the service is read-only for maintenance; try again later")
+	ErrUnavailable = errors.New("storage unavailable")
+)
+
+// ErrNotSupported is returned by optional operations a store can't provide.
+var ErrNotSupported = errors.New("not supported by this storage")
+
+// ErrVersionConflict is returned by Save when the todo carries a version other
+// than the stored one, meaning it was changed by someone else since it was read.
+var ErrVersionConflict = kindError(ErrConflict, "version conflict: the todo has changed since it was read")
+
+// ErrAlreadyExists is returned by Create when the id is in use.
+var ErrAlreadyExists = kindError(ErrConflict, "a todo with this id already exists")
+
+// ErrDuplicateOrder is returned under OrderReject when a todo would share its
+// Order with another.
+var ErrDuplicateOrder = kindError(ErrConflict, "another todo already has this order")
+
+// ErrHasSubtasks is returned by deletes of todos with subtasks when those
+// aren't deleted along with them.
+var ErrHasSubtasks = kindError(ErrConflict, "a todo being deleted has subtasks; delete them first")
+
+// ErrTitleTaken is returned under -unique-titles when another todo already
+// has the title.
+var ErrTitleTaken = kindError(ErrConflict, "another todo already has this title")
+
+// ErrMissingAnchor is returned by Move when the todo to move next to doesn't
+// exist.
+var ErrMissingAnchor = kindError(ErrValidation, "the todo to move next to doesn't exist")
+
+// ErrMissingParent is returned when a todo is created as a subtask of one
+// that doesn't exist.
+var ErrMissingParent = kindError(ErrValidation, "the parent todo doesn't exist")
+
+// ErrInvalidOrder is returned by Reorder when the ids list a todo that
+// doesn't exist, or one twice.
+var ErrInvalidOrder = kindError(ErrValidation, "the order must list existing todos, once each")
+
+// ErrIncompleteOrder is returned by Reorder when it must be given every todo
+// and isn't.
+var ErrIncompleteOrder = kindError(ErrValidation, "the order leaves out todos")
+
+// ErrCircuitOpen is returned without calling storage while the circuit
+// breaker is open.
+var ErrCircuitOpen = kindError(ErrUnavailable, "storage unavailable: circuit breaker open")
+
+// kindedError is an error of one of the kinds above, with its own message.
+type kindedError struct {
+	kind    error
+	message string
+}
+
+func (e *kindedError) Error() string { return e.message }
+func (e *kindedError) Unwrap() error { return e.kind }
+
+func kindError(kind error, message string) error {
+	return &kindedError{kind: kind, message: message}
+}
+
+// invalidf formats a validation error, such as a todo breaking a limit.
+func invalidf(format string, args ...interface{}) error {
+	return kindError(ErrValidation, fmt.Sprintf(format, args...))
+}
+
+// decodeError gives a JSON decoding error its kind: malformed when the body
+// isn't JSON at all, and invalid when it is but doesn't fit, such as a
+// string where a todo has a number.
+func decodeError(err error) error {
+	var syntax *json.SyntaxError
+	if errors.As(err, &syntax) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+		return kindError(ErrMalformed, err.Error())
+	}
+	return kindError(ErrValidation, err.Error())
+}
+
+// errorStatus is the HTTP status answering err: 500 unless it is of a kind
+// above. A request that can't be parsed is a 400 and one that parses but is
+// invalid a 422, whichever route it is sent to.
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrMalformed):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrConflict):
+		return http.StatusConflict
+	case errors.Is(err, ErrValidation):
+		return 422
+	case errors.Is(err, ErrReadOnly), errors.Is(err, ErrUnavailable):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, ErrNotSupported):
+		return http.StatusNotImplemented
+	}
+	return http.StatusInternalServerError
+}
+
+// writeStorageError answers with err and the status errorStatus gives it.
+func writeStorageError(w http.ResponseWriter, r *http.Request, err error) {
+	writeError(w, r, err.Error(), errorStatus(err))
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With -events-url every change the store makes to a todo, including those
+// made by bulk writes, is published for downstream systems as a JSON
+// changeEvent. Publishing happens in the background: a request never waits
+// for it or fails because of it. Events that still fail after
+// -events-retries tries, or that arrive while eventQueueSize are waiting,
+// are logged and dropped, so this is a feed for integrations rather than a
+// log to rebuild the store from.
+
+const eventQueueSize = 1000
+
+// changeEvent is the message published for a change to one todo.
+type changeEvent struct {
+	Type string          `json:"type"` // todo.created, todo.updated or todo.deleted
+	Id   json.RawMessage `json:"id"`
+	Todo *Todo           `json:"todo"`
+	At   time.Time       `json:"at"`
+}
+
+func newChangeEvent(todo *Todo) changeEvent {
+	kind := "todo.updated"
+	switch {
+	case todo.DeletedAt != nil:
+		kind = "todo.deleted"
+	case todo.Version == 1:
+		kind = "todo.created"
+	}
+	return changeEvent{Type: kind, Id: jsonId(todo.Id), Todo: todo, At: todo.UpdatedAt}
+}
+
+// eventSink delivers one message, returning once it has been accepted.
+type eventSink interface {
+	publish(payload []byte) error
+	close()
+}
+
+// newEventSink connects to the sink at rawUrl, picked by its scheme:
+// nats://[user:pass@]host:port publishes on subject, and http(s) posts each
+// event to the url.
+func newEventSink(rawUrl, subject string) (eventSink, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid events url %q: %v", rawUrl, err)
+	}
+	switch u.Scheme {
+	case "nats":
+		if subject == "" || strings.ContainsAny(subject, " \t\r\n") {
+			return nil, fmt.Errorf("invalid events subject %q: must be a NATS subject", subject)
+		}
+		return &natsSink{url: u, subject: subject}, nil
+	case "http", "https":
+		return &webhookSink{url: rawUrl, client: &http.Client{Timeout: 5 * time.Second}}, nil
+	}
+	return nil, fmt.Errorf("invalid events url %q: the scheme must be nats, http or https", rawUrl)
+}
+
+// eventPublisher hands changes to a sink from a single goroutine, in the
+// order the store made them.
+type eventPublisher struct {
+	sink    eventSink
+	retries int
+	queue   chan *Todo
+	done    chan struct{}
+
+	m      sync.Mutex
+	closed bool
+}
+
+// Events publishes changes when -events-url is set, and is nil otherwise.
+var Events *eventPublisher
+
+func newEventPublisher(sink eventSink, retries int) *eventPublisher {
+	p := &eventPublisher{
+		sink:    sink,
+		retries: retries,
+		queue:   make(chan *Todo, eventQueueSize),
+		done:    make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+// changed queues an event for the todo. It never blocks, since stores call
+// it while holding their lock.
+func (p *eventPublisher) changed(todo *Todo) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if p.closed {
+		return // Shutting down; a background write came too late
+	}
+	select {
+	case p.queue <- todo.clone():
+	default:
+		log.Printf("events: queue full, dropping the change to todo %s", encodeId(todo.Id))
+	}
+}
+
+func (p *eventPublisher) run() {
+	defer close(p.done)
+	for todo := range p.queue {
+		event := newChangeEvent(todo)
+		payload, err := json.Marshal(event)
+		if err == nil {
+			err = p.send(payload)
+		}
+		if err != nil {
+			log.Printf("events: dropping %s for todo %s: %v", event.Type, encodeId(todo.Id), err)
+		}
+	}
+	p.sink.close()
+}
+
+// send publishes payload, trying again with backoff up to p.retries times.
+func (p *eventPublisher) send(payload []byte) error {
+	backoff := 100 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		err := p.sink.publish(payload)
+		if err == nil || attempt >= p.retries {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff = min(2*backoff, 5*time.Second)
+	}
+}
+
+// close publishes what is queued, waiting up to timeout for it, and stops.
+// Changes after it aren't published.
+func (p *eventPublisher) close(timeout time.Duration) {
+	p.m.Lock()
+	p.closed = true
+	close(p.queue)
+	p.m.Unlock()
+	select {
+	case <-p.done:
+	case <-time.After(timeout):
+		log.Printf("events: %d changes still unpublished after %v", len(p.queue), timeout)
+	}
+}
+
+// natsSink publishes over the NATS client protocol, which is plain text, so
+// there is no need for a client library. Each message is followed by a PING
+// so it is only reported sent once the server has taken it.
+type natsSink struct {
+	url     *url.URL
+	subject string
+	conn    net.Conn
+	r       *bufio.Reader
+}
+
+func (s *natsSink) publish(payload []byte) error {
+	if s.conn == nil {
+		if err := s.connect(); err != nil {
+			return err
+		}
+	}
+	s.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "PUB %s %d\r\n", s.subject, len(payload))
+	msg.Write(payload)
+	msg.WriteString("\r\nPING\r\n")
+	_, err := s.conn.Write(msg.Bytes())
+	if err == nil {
+		err = s.awaitPong()
+	}
+	if err != nil {
+		s.close() // Reconnect on the next try
+	}
+	return err
+}
+
+func (s *natsSink) connect() error {
+	host := s.url.Host
+	if s.url.Port() == "" {
+		host = net.JoinHostPort(s.url.Hostname(), "4222")
+	}
+	conn, err := net.DialTimeout("tcp", host, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	s.conn, s.r = conn, bufio.NewReader(conn)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	line, err := s.r.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "INFO ") {
+		s.close()
+		return fmt.Errorf("nats: unexpected greeting %q: %v", strings.TrimSpace(line), err)
+	}
+	options := map[string]interface{}{"verbose": false, "pedantic": false, "name": "todo-backend"}
+	if user := s.url.User; user != nil {
+		options["user"] = user.Username()
+		options["pass"], _ = user.Password()
+	}
+	connect, _ := json.Marshal(options)
+	if _, err := fmt.Fprintf(conn, "CONNECT %s\r\nPING\r\n", connect); err != nil {
+		s.close()
+		return err
+	}
+	if err := s.awaitPong(); err != nil {
+		s.close()
+		return err
+	}
+	return nil
+}
+
+// awaitPong reads until the PONG answering our PING, answering the server's
+// own PINGs and returning any error it reports.
+func (s *natsSink) awaitPong() error {
+	for {
+		line, err := s.r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			if _, err := s.conn.Write([]byte("PONG\r\n")); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return errors.New("nats: " + strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		}
+	}
+}
+
+func (s *natsSink) close() {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn, s.r = nil, nil
+	}
+}
+
+// webhookSink posts each event to a url, expecting a 2xx.
+type webhookSink struct {
+	url    string
+	client *http.Client
+}
+
+func (s *webhookSink) publish(payload []byte) error {
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s answered %s", s.url, resp.Status)
+	}
+	return nil
+}
+
+func (s *webhookSink) close() {}
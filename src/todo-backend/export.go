@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// exportHandler streams a consistent backup of every todo as a JSON array.
+// The snapshot is taken up front so writes continue while it is sent.
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, r, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	todos, err := storageFor(r).Snapshot()
+	if err == ErrNotSupported {
+		writeError(w, r, "Export is not supported by this storage", http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		writeStorageError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", `attachment; filename="todos.json"`)
+	rc := http.NewResponseController(w)
+	enc := json.NewEncoder(w)
+	if *envelopeMode {
+		w.Write([]byte(`{"data":`))
+	}
+	w.Write([]byte("["))
+	for i, todo := range todos {
+		if i > 0 {
+			w.Write([]byte(","))
+		}
+		prepareTodos(r, todo)
+		if err := enc.Encode(todo); err != nil {
+			return // The client has gone
+		}
+		if i%100 == 99 {
+			rc.Flush() // Not every writer can; the rest arrives at the end
+		}
+	}
+	if *envelopeMode {
+		fmt.Fprintf(w, `],"meta":{"total":%d}}`+"\n", len(todos))
+		return
+	}
+	w.Write([]byte("]\n"))
+}
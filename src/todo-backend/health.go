@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+type healthStatus struct {
+	Status      string             `json:"status"`
+	LatencyMs   float64            `json:"latency_ms"`
+	ReadOnly    bool               `json:"read_only"`
+	Error       string             `json:"error,omitempty"`
+	Maintenance *maintenanceNotice `json:"maintenance,omitempty"`
+	Breaker     string             `json:"breaker,omitempty"` // With -breaker-failures
+}
+
+// checkStorage times a storage round trip, giving up after timeout so a hung
+// backend can't hang the probe.
+func checkStorage(svc TodoService, timeout time.Duration) (time.Duration, error) {
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		_, err := svc.Count()
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		return time.Since(start), err
+	case <-time.After(timeout):
+		return timeout, errors.New("storage check timed out")
+	}
+}
+
+// readyHandler serves /readyz, which fails once shutdown starts so load
+// balancers stop sending requests during -shutdown-delay. Unlike /healthz it
+// doesn't touch storage.
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		writeError(w, r, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	status := "ready"
+	if shuttingDown.Load() {
+		status = "shutting down"
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	writeJson(w, map[string]string{"status": status})
+}
+
+// waitForStorage checks svc until it answers, backing off between tries, so
+// the server can start before its database does. It gives up with the last
+// error after timeout. In-memory stores are ready once made and aren't
+// checked.
+func waitForStorage(svc TodoService, timeout time.Duration) error {
+	if inMemory(svc) {
+		return nil
+	}
+	deadline := time.Now().Add(timeout)
+	backoff := 100 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		_, err := checkStorage(svc, *healthTimeout)
+		if err == nil {
+			if attempt > 1 {
+				log.Printf("storage ready after %d attempts", attempt)
+			}
+			return nil
+		}
+		if time.Now().Add(backoff).After(deadline) {
+			return fmt.Errorf("storage not ready after %v: %v", timeout, err)
+		}
+		log.Printf("storage not ready (attempt %d): %v; retrying in %v", attempt, err, backoff)
+		time.Sleep(backoff)
+		backoff = min(2*backoff, 5*time.Second)
+	}
+}
+
+// inMemory reports whether svc keeps everything in this process.
+func inMemory(svc TodoService) bool {
+	switch svc := svc.(type) {
+	case *MockTodoService:
+		return true
+	case *MirrorTodoService:
+		return inMemory(svc.primary) && inMemory(svc.secondary)
+	}
+	return false
+}
+
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		writeError(w, r, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	latency, err := checkStorage(TodoSvc, *healthTimeout)
+	status := healthStatus{
+		Status:      "ok",
+		LatencyMs:   float64(latency) / float64(time.Millisecond),
+		ReadOnly:    readOnly.Load(),
+		Maintenance: currentMaintenance(),
+	}
+	if Breaker != nil {
+		status.Breaker = Breaker.State()
+	}
+	if err == nil && latency > *healthMaxLatency {
+		err = errors.New("storage latency above threshold")
+	}
+	if err != nil {
+		status.Status = "unavailable"
+		status.Error = err.Error()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	writeJson(w, status)
+}
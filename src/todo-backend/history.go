@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// historyHandler serves GET /todos/{id}/history, the versions the todo has
+// been saved as, newest first, paged with ?offset= and ?limit=. The total
+// number kept is sent in X-Total-Count.
+func historyHandler(w http.ResponseWriter, r *http.Request, key string) {
+	if r.Method != "GET" {
+		writeError(w, r, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := decodeId(key)
+	if err != nil {
+		writeError(w, r, "Invalid Id", http.StatusBadRequest)
+		return
+	}
+	w.Header().Add("Vary", "X-Default-Page-Size")
+	offset, limit, err := parsePage(r)
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	versions, total, err := storageFor(r).History(id, offset, limit)
+	if err != nil {
+		writeStorageError(w, r, err)
+		return
+	}
+	if total == 0 {
+		// Nothing recorded: the todo may predate the history or never
+		// have existed.
+		todo, err := storageFor(r).Get(id)
+		if err != nil {
+			writeStorageError(w, r, err)
+			return
+		}
+		if todo == nil {
+			writeError(w, r, "Not Found", http.StatusNotFound)
+			return
+		}
+	}
+	prepareTodos(r, versions...)
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	setMaxPageSize(w)
+	writeJsonMeta(w, versions, envelopeMeta{"total": total, "offset": offset, "limit": limit})
+}
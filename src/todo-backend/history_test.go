@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestHistoryLimitIsCapped(t *testing.T) {
+	store := useStore(t)
+	store.HistoryLimit = 50
+	todo := &Todo{Title: "v0"}
+	if err := store.Save(todo); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < 20; i++ {
+		if err := store.Save(&Todo{Id: todo.Id, Title: fmt.Sprintf("v%d", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func(max int) { *maxPageSize = max }(*maxPageSize)
+	*maxPageSize = 8
+
+	w := send("GET", "/todos/1/history?limit=10000", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET history: %d %s", w.Code, w.Body)
+	}
+	var versions []*Todo
+	if err := json.Unmarshal(w.Body.Bytes(), &versions); err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != *maxPageSize {
+		t.Fatalf("?limit=10000 gave %d versions, want the max of %d", len(versions), *maxPageSize)
+	}
+	if got := w.Header().Get("X-Max-Page-Size"); got != strconv.Itoa(*maxPageSize) {
+		t.Fatalf("X-Max-Page-Size is %q, want %d", got, *maxPageSize)
+	}
+	if got := w.Header().Get("X-Total-Count"); got != "20" {
+		t.Fatalf("X-Total-Count is %q, want 20", got)
+	}
+}
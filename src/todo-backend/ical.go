@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+)
+
+const icalTime = "20060102T150405Z"
+
+var icalEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`)
+
+// icalHandler serves incomplete todos with a due date as an RFC 5545
+// calendar of VTODOs that calendar apps can subscribe to.
+func icalHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, r, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	todos, err := storageFor(r).GetAll()
+	if err != nil {
+		writeStorageError(w, r, err)
+		return
+	}
+	prepareTodos(r, todos...)
+
+	var b bytes.Buffer
+	line := func(s string) {
+		// Fold lines longer than 75 octets, without splitting UTF-8 sequences
+		for len(s) > 75 {
+			i := 75
+			for i > 0 && s[i]&0xC0 == 0x80 {
+				i--
+			}
+			b.WriteString(s[:i] + "\r\n ")
+			s = s[i:]
+		}
+		b.WriteString(s + "\r\n")
+	}
+
+	line("BEGIN:VCALENDAR")
+	line("VERSION:2.0")
+	line("PRODID:-//todo-backend-golang//EN")
+	for _, todo := range todos {
+		if todo.Completed || todo.DueDate == nil {
+			continue
+		}
+		line("BEGIN:VTODO")
+		line("UID:" + encodeId(todo.Id) + "@" + r.Host)
+		line("DTSTAMP:" + todo.UpdatedAt.UTC().Format(icalTime))
+		line("DUE:" + todo.DueDate.UTC().Format(icalTime))
+		line("SUMMARY:" + icalEscaper.Replace(todo.Title))
+		if todo.Url != "" {
+			line("URL:" + todo.Url)
+		}
+		line("STATUS:NEEDS-ACTION")
+		line("END:VTODO")
+	}
+	line("END:VCALENDAR")
+
+	w.Header().Set("Content-Type", "text/calendar; charset=UTF-8")
+	w.Write(b.Bytes())
+}
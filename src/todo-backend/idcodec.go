@@ -0,0 +1,214 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Todo ids are ints in storage. How they appear in urls and bodies is up to
+// the deployment's idCodec, picked with -id-type:
+//
+//	int   plain integers, or with -id-salt, base 62 tokens
+//	uuid  UUIDs (version 8, which leaves the layout to us) carrying the id
+//
+// With -id-salt the id is first shuffled with a keyed permutation so
+// sequential ids can't be enumerated. The same salt gives the same ids across
+// restarts. This hides ids; it is not access control. Since every UUID stands
+// for an int id, a client choosing its own id must pick one the codec made,
+// not just any UUID.
+
+var errInvalidId = errors.New("invalid id")
+
+// idCodec formats storage ids for clients and parses them back.
+type idCodec interface {
+	encode(id int) string
+	// decode returns errInvalidId for anything encode couldn't have made.
+	decode(s string) (int, error)
+}
+
+// todoIds is the configured codec, set by parseConfig.
+var todoIds idCodec = intIds{}
+
+func newIdCodec(idType, salt string) (idCodec, error) {
+	switch idType {
+	case "int":
+		if salt != "" {
+			return tokenIds{}, nil
+		}
+		return intIds{}, nil
+	case "uuid":
+		return uuidIds{}, nil
+	}
+	return nil, fmt.Errorf("invalid id type %q: must be int or uuid", idType)
+}
+
+func encodeId(id int) string {
+	return todoIds.encode(id)
+}
+
+func decodeId(s string) (int, error) {
+	return todoIds.decode(s)
+}
+
+// jsonId is id as it appears in a JSON body: a number for plain int ids and a
+// string otherwise.
+func jsonId(id int) json.RawMessage {
+	if _, ok := todoIds.(intIds); ok {
+		return json.RawMessage(strconv.Itoa(id))
+	}
+	return json.RawMessage(strconv.Quote(encodeId(id)))
+}
+
+// todoRef is a todo id held in a todo, such as its parent, which JSON shows
+// the way jsonId does.
+type todoRef int
+
+func (id todoRef) MarshalJSON() ([]byte, error) {
+	return jsonId(int(id)), nil
+}
+
+func (id *todoRef) UnmarshalJSON(b []byte) error {
+	v, err := decodeJsonId(b)
+	if err != nil {
+		return err
+	}
+	*id = todoRef(v)
+	return nil
+}
+
+// shuffleId permutes an id by the salt, if there is one.
+func shuffleId(id int) uint64 {
+	if *idSalt == "" {
+		return uint64(id)
+	}
+	return permuteId(uint64(id), false)
+}
+
+// unshuffleId undoes shuffleId, checking the result is a valid id.
+func unshuffleId(n uint64) (int, error) {
+	if *idSalt != "" {
+		n = permuteId(n, true)
+	}
+	if n == 0 || n > math.MaxInt64 {
+		return 0, errInvalidId
+	}
+	return int(n), nil
+}
+
+// intIds are the ids themselves.
+type intIds struct{}
+
+func (intIds) encode(id int) string {
+	return strconv.Itoa(id)
+}
+
+func (intIds) decode(s string) (int, error) {
+	id, err := strconv.Atoi(s)
+	if err != nil || id <= 0 {
+		return 0, errInvalidId
+	}
+	return id, nil
+}
+
+// tokenIds write shuffled ids in base 62.
+type tokenIds struct{}
+
+const base62 = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+const feistelRounds = 4
+
+func (tokenIds) encode(id int) string {
+	n := shuffleId(id)
+	var b []byte
+	for {
+		b = append(b, base62[n%62])
+		n /= 62
+		if n == 0 {
+			break
+		}
+	}
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return string(b)
+}
+
+func (c tokenIds) decode(s string) (int, error) {
+	if s == "" || len(s) > 11 { // 62^11 > 2^64
+		return 0, errInvalidId
+	}
+	var n uint64
+	for i := 0; i < len(s); i++ {
+		d := strings.IndexByte(base62, s[i])
+		if d < 0 {
+			return 0, errInvalidId
+		}
+		if n > (math.MaxUint64-uint64(d))/62 {
+			return 0, errInvalidId
+		}
+		n = n*62 + uint64(d)
+	}
+
+	id, err := unshuffleId(n)
+	if err != nil || c.encode(id) != s {
+		return 0, errInvalidId
+	}
+	return id, nil
+}
+
+// uuidIds put the high half of the shuffled id in the first 32 bits of a
+// UUID and the low half in the last 32, leaving the rest zero apart from the
+// version and variant, so without a salt id 1 is
+// 00000000-0000-8000-8000-000000000001.
+type uuidIds struct{}
+
+func (uuidIds) encode(id int) string {
+	n := shuffleId(id)
+	return fmt.Sprintf("%08x-0000-8000-8000-0000%08x", uint32(n>>32), uint32(n))
+}
+
+func (uuidIds) decode(s string) (int, error) {
+	s = strings.ToLower(s)
+	if len(s) != 36 || s[8:28] != "-0000-8000-8000-0000" {
+		return 0, errInvalidId
+	}
+	hi, err := strconv.ParseUint(s[:8], 16, 32)
+	if err != nil {
+		return 0, errInvalidId
+	}
+	lo, err := strconv.ParseUint(s[28:], 16, 32)
+	if err != nil {
+		return 0, errInvalidId
+	}
+	return unshuffleId(hi<<32 | lo)
+}
+
+// permuteId applies (or with inverse, undoes) a Feistel network keyed by the
+// salt, a bijection on 64-bit values.
+func permuteId(n uint64, inverse bool) uint64 {
+	l, r := uint32(n>>32), uint32(n)
+	for i := 0; i < feistelRounds; i++ {
+		if inverse {
+			l, r = r^feistelRound(feistelRounds-1-i, l), l
+		} else {
+			l, r = r, l^feistelRound(i, r)
+		}
+	}
+	return uint64(l)<<32 | uint64(r)
+}
+
+func feistelRound(round int, half uint32) uint32 {
+	var b [5]byte
+	b[0] = byte(round)
+	binary.BigEndian.PutUint32(b[1:], half)
+	h := sha256.New()
+	h.Write([]byte(*idSalt))
+	h.Write(b[:])
+	return binary.BigEndian.Uint32(h.Sum(nil))
+}
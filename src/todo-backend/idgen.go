@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"sync"
+)
+
+// IDGenerator hands out ids for new todos. Ids must be positive, since 0
+// means unassigned.
+type IDGenerator interface {
+	Next() (int, error)
+}
+
+// ErrIdsExhausted is returned when a generator has no ids left to give.
+var ErrIdsExhausted = errors.New("todo ids exhausted")
+
+// SequentialIDGenerator counts up from a starting id. Ids are never reused,
+// so it stops with ErrIdsExhausted at math.MaxInt rather than wrapping
+// negative.
+type SequentialIDGenerator struct {
+	m    sync.Mutex
+	next int
+}
+
+func NewSequentialIDGenerator(start int) *SequentialIDGenerator {
+	return &SequentialIDGenerator{next: start}
+}
+
+func (g *SequentialIDGenerator) Next() (int, error) {
+	g.m.Lock()
+	defer g.m.Unlock()
+	if g.next == math.MaxInt {
+		return 0, ErrIdsExhausted
+	}
+	id := g.next
+	g.next++
+	return id, nil
+}
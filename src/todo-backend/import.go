@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+)
+
+// importHandler serves POST /import, loading a JSON array of todos such as
+// GET /export writes. The array is decoded as it arrives and saved in
+// batches of -import-batch-size, so memory stays bounded however large the
+// backup; bodies may be up to -max-import-size. Todos get new ids.
+//
+// What a todo that fails to parse, validate or save does depends on ?mode=:
+//
+//	batch    (the default) it stops the import. The todos saved from its
+//	         batch are deleted again, earlier batches are kept, and the error
+//	         says how many todos were imported.
+//	atomic   it stops the import and every todo saved by it is deleted again.
+//	partial  it is skipped and the rest are still saved. The answer is a 207
+//	         with the outcome of each todo, by its index in the array.
+//
+// Under -unique-titles a todo whose title is taken, by one imported before it
+// included, fails to save with a 409.
+//
+// The store has no transactions, so a rolled back todo is briefly visible
+// and then shows as deleted in ?since= syncs. A body that stops being JSON
+// stops even a partial import, since nothing after it can be read.
+func importHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, r, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	mode := r.URL.Query().Get("mode")
+	switch mode {
+	case "":
+		mode = "batch"
+	case "batch", "atomic", "partial":
+	default:
+		writeError(w, r, fmt.Sprintf("Invalid mode %q: must be batch, atomic or partial", mode), http.StatusBadRequest)
+		return
+	}
+
+	imported := 0
+	var saved []int // With ?mode=atomic, every todo imported so far
+	report := importReport{Results: make([]importResult, 0)}
+	batch := make([]*Todo, 0, *importBatchSize)
+	start := 0 // The index of the batch's first todo
+	// rollback deletes todos the import saved, leaving them out of the
+	// undo history since the import as a whole failed.
+	rollback := func(ids []int) {
+		if err := Undoable.discard(ids); err != nil {
+			log.Printf("import: rolling back: %v", err)
+		}
+	}
+	// flush saves the batch, deleting what it saved if a save fails, or
+	// with ?mode=partial skipping the todo and going on.
+	flush := func() (int, error) {
+		for i, todo := range batch {
+			todo.Id = 0 // Ids are assigned by the store
+			// Their parents' ids change too, so subtasks come in as
+			// top-level todos.
+			todo.ParentId = nil
+			// Checked here rather than as the todo is read so it sees
+			// the todos saved before it, including this import's own.
+			err := checkTitle(r, todo.Title, 0)
+			if err == nil {
+				err = storageFor(r).Save(todo)
+			}
+			switch {
+			case err != nil && mode == "partial":
+				report.add(start+i, nil, errorStatus(err), err)
+				continue
+			case err != nil:
+				ids := make([]int, i)
+				for j, done := range batch[:i] {
+					ids[j] = done.Id
+				}
+				rollback(ids)
+				return i, err
+			case mode == "partial":
+				report.add(start+i, todo, http.StatusCreated, nil)
+				imported++
+			}
+		}
+		if mode != "partial" {
+			imported += len(batch)
+		}
+		if mode == "atomic" {
+			for _, todo := range batch {
+				saved = append(saved, todo.Id)
+			}
+		}
+		batch = batch[:0]
+		return 0, nil
+	}
+
+	fail := func(index int, err error, code int) {
+		if maxErr := (*http.MaxBytesError)(nil); errors.As(err, &maxErr) {
+			code = http.StatusRequestEntityTooLarge
+		}
+		switch {
+		case mode == "partial" && (index >= 0 || len(batch) > 0 || len(report.Results) > 0):
+			flush()
+			if index >= 0 {
+				report.add(index, nil, code, err)
+			}
+			report.Error = err.Error()
+			writeImportReport(w, report)
+			return
+		case mode == "atomic":
+			rollback(saved)
+			imported = 0
+		}
+		msg := fmt.Sprintf("todo %d: %v; the %d todos before its batch were imported", index, err, imported)
+		if mode == "atomic" {
+			msg = fmt.Sprintf("todo %d: %v; no todos were imported", index, err)
+		}
+		if index < 0 {
+			msg = fmt.Sprintf("%v; %d todos imported", err, imported)
+		}
+		writeError(w, r, msg, code)
+	}
+
+	dec := json.NewDecoder(r.Body)
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+		if err == nil || err == io.EOF {
+			err = errors.New("request body must be a JSON array of todos")
+		}
+		fail(-1, err, http.StatusBadRequest)
+		return
+	}
+
+	// reject answers a todo that can't be saved, returning whether to go
+	// on with the rest.
+	reject := func(index int, err error, code int) bool {
+		if mode != "partial" {
+			fail(index, err, code)
+			return false
+		}
+		flush() // So the results stay in order; it can't fail when partial
+		report.add(index, nil, code, err)
+		return true
+	}
+
+	for index := 0; dec.More(); index++ {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			fail(index, err, http.StatusBadRequest)
+			return
+		}
+		if len(batch) == 0 {
+			start = index
+		}
+		violations, err := checkSchema(raw, createTodoSchema)
+		if err != nil {
+			if !reject(index, err, 422) {
+				return
+			}
+			continue
+		}
+		if len(violations) > 0 {
+			if !reject(index, fmt.Errorf("does not match schema: %s", violations[0]), 422) {
+				return
+			}
+			continue
+		}
+		todo := newTodo()
+		if err := json.Unmarshal(raw, todo); err != nil {
+			if !reject(index, err, 422) {
+				return
+			}
+			continue
+		}
+		if _, err := checkLimits(todo); err != nil {
+			if !reject(index, err, errorStatus(err)) {
+				return
+			}
+			continue
+		}
+		batch = append(batch, todo)
+		if len(batch) == cap(batch) {
+			if i, err := flush(); err != nil {
+				fail(start+i, err, errorStatus(err))
+				return
+			}
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		fail(-1, err, http.StatusBadRequest)
+		return
+	}
+	if i, err := flush(); err != nil {
+		fail(start+i, err, errorStatus(err))
+		return
+	}
+
+	if mode == "partial" {
+		writeImportReport(w, report)
+		return
+	}
+	writeJson(w, map[string]int{"imported": imported})
+}
+
+// importReport answers a ?mode=partial import.
+type importReport struct {
+	Imported int            `json:"imported"`
+	Failed   int            `json:"failed"`
+	Results  []importResult `json:"results"`         // In the order of the array
+	Error    string         `json:"error,omitempty"` // Why the import stopped early, if it did
+}
+
+// importResult is how one todo of a ?mode=partial import went: a 201 with
+// the id it was given, or the status and error a single write would get.
+type importResult struct {
+	Index  int             `json:"index"`
+	Id     json.RawMessage `json:"id,omitempty"`
+	Status int             `json:"status"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// add records the outcome for the todo at index, which is saved when err is
+// nil.
+func (rep *importReport) add(index int, saved *Todo, status int, err error) {
+	result := importResult{Index: index, Status: status}
+	if err != nil {
+		result.Error = err.Error()
+		rep.Failed++
+	} else {
+		result.Id = jsonId(saved.Id)
+		rep.Imported++
+	}
+	rep.Results = append(rep.Results, result)
+}
+
+func writeImportReport(w http.ResponseWriter, report importReport) {
+	w.WriteHeader(http.StatusMultiStatus)
+	writeJson(w, report)
+}
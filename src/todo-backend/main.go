@@ -1,42 +1,673 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"maps"
 	"net/http"
+	"net/http/pprof"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
-var TodoSvc *MockTodoService
+var TodoSvc TodoService
 
 func main() {
-	port := os.Getenv("PORT")
+	if err := parseConfig(); err != nil {
+		log.Fatal(err)
+	}
+
+	if *selftest != "" {
+		if !runSelftest(*selftest, os.Stdout) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	addr := *listenAddr
+	if addr == "" {
+		port := os.Getenv("PORT")
+		if port == "" {
+			log.Fatal("$PORT or -addr must be set")
+		}
+		addr = ":" + port
+	}
+	if strings.HasPrefix(addr, "unix:") && *publicUrl == "" {
+		log.Printf("listening on a Unix socket without -public-url; todo urls will use whatever Host clients send")
+	}
+
+	if *securityLogPath != "" {
+		var err error
+		if SecurityLog, err = openSecurityLog(*securityLogPath); err != nil {
+			log.Fatalf("opening the security log: %v", err)
+		}
+	}
+
+	var onChange func(*Todo)
+	if *eventsUrl != "" {
+		sink, err := newEventSink(*eventsUrl, *eventsSubject)
+		if err != nil {
+			log.Fatal(err)
+		}
+		Events = newEventPublisher(sink, *eventsRetries)
+		onChange = Events.changed
+	}
+
+	svc, err := newTodoService(*storage, storeOptions{
+		MirrorSample:   *mirrorSample,
+		OrderMode:      OrderMode(*orderMode),
+		HistoryLimit:   *historyLimit,
+		CascadeDeletes: *cascadeDeletes,
+		OnChange:       onChange,
+		Clock:          clock,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *startupTimeout > 0 {
+		if err := waitForStorage(svc, *startupTimeout); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *breakerFailures > 0 {
+		Breaker = NewCircuitBreakerTodoService(svc, *breakerFailures, *breakerCooldown)
+		svc = Breaker
+	}
+	Undoable = &undoableTodoService{TodoService: &notifyingTodoService{svc, Changes}, limit: *undoHistory}
+	TodoSvc = &dedupedTodoService{TodoService: Undoable, feed: Changes}
 
-	if port == "" {
-		log.Fatal("$PORT must be set")
+	if *seed != "" {
+		if err := seedTodos(*seed, *seedForce); err != nil {
+			log.Fatalf("seeding from %s: %v", *seed, err)
+		}
+	}
+	readOnly.Store(*startReadOnly)
+	go toggleReadOnlyOnSignal()
+	if *orderCheckInterval > 0 {
+		go renormalizeOrders(*orderCheckInterval, *orderMinGap)
+	}
+	if *purgeInterval > 0 && *purgeAfter > 0 {
+		go purgeDeleted(*purgeInterval, *purgeAfter)
 	}
 
-	TodoSvc = NewMockTodoService()
 	mux := http.NewServeMux()
 
 	mux.Handle("/todos", commonHandlers(todoHandler))
 	mux.Handle("/todos/", commonHandlers(todoHandler))
+	mux.Handle("/todos.ics", commonHandlers(icalHandler))
+	mux.Handle("/todos/stats", commonHandlers(statsHandler))
+	mux.Handle("/todos/grouped", commonHandlers(groupedHandler))
+	mux.Handle("/todos/summary", commonHandlers(summaryHandler))
+	mux.Handle("/todos/archive-completed", commonHandlers(archiveCompletedHandler))
+	mux.Handle("/todos/undo", commonHandlers(undoHandler))
+	mux.Handle("/todos/order", commonHandlers(reorderHandler))
+	mux.Handle("/export", commonHandlers(exportHandler))
+	mux.Handle("/import", commonHandlers(importHandler))
+	mux.Handle("/tags", commonHandlers(tagsHandler))
+	mux.Handle("/rpc", commonHandlers(rpcHandler))
+	mux.Handle("/healthz", commonHandlers(healthHandler))
+	mux.Handle("/readyz", commonHandlers(readyHandler))
+	mux.HandleFunc("/favicon.ico", faviconHandler)
+	mux.Handle("/", commonHandlers(indexHandler))
+	if *enablePprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+	if *debugEchoToken != "" {
+		mux.Handle("/debug/echo", commonHandlers(echoHandler))
+	}
+
+	// Middleware shared by every route, innermost first
+	var handler http.Handler = mux
+	handler = rejectWrites(handler)
+	handler = failFastWhenOpen(handler)
+	handler = serverTiming(handler)
+	handler = shedLoad(*maxInFlight, *queueTimeout, handler)
+	handler = limitPerClient(*maxClientInFlight, handler)
+	handler = canonicalize(*canonicalHost, handler)
+	handler = stripPrefix(*basePath, handler)
+	handler = announceMaintenance(handler)
+	handler = recoverPanics(handler)
+	handler = loggingHandler(handler)
+	handler = logSecurityEvents(handler)
+	handler = requestIds(handler)
 
-	log.Fatal(http.ListenAndServe(":"+port, mux))
+	server := &http.Server{
+		Addr:    addr,
+		Handler: handler,
+	}
+	if *h2c {
+		// Plaintext HTTP/2 for use behind a proxy; HTTP/1 still works
+		server.Protocols = new(http.Protocols)
+		server.Protocols.SetHTTP1(true)
+		server.Protocols.SetUnencryptedHTTP2(true)
+	}
+	ln, err := listen(addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := serve(server, ln); err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	if Events != nil {
+		Events.close(*drainTimeout)
+	}
+}
+
+// prepareTodos fills in what the todos in a response show that depends on the
+// request: their urls, unless turned off with -urls or ?urls=false, and their
+// times in the client's zone.
+func prepareTodos(r *http.Request, todos ...*Todo) {
+	localizeTodos(r, todos...)
+
+	show := *showUrls
+	if b, err := strconv.ParseBool(r.URL.Query().Get("urls")); err == nil {
+		show = b
+	}
+	for _, todo := range todos {
+		todo.Url = ""
+		if show {
+			todo.Url = todoUrl(r, todo.Id)
+		}
+	}
+}
+
+// todoUrl is the url of a todo: under -public-url when set, and otherwise on
+// the host the request came to.
+func todoUrl(r *http.Request, id int) string {
+	if *publicUrl != "" {
+		return strings.TrimSuffix(*publicUrl, "/") + *basePath + "/todos/" + encodeId(id)
+	}
+	host := r.Host
+	if *canonicalHost != "" {
+		host = *canonicalHost
+	}
+	return publicScheme(r) + "://" + host + *basePath + "/todos/" + encodeId(id)
 }
 
-func addUrlToTodos(r *http.Request, todos ...*Todo) {
-	scheme := "http"
+// publicScheme is the scheme clients reach the server with: -public-url's if
+// set, otherwise the request's.
+func publicScheme(r *http.Request) string {
+	if *publicUrl != "" {
+		u, _ := url.Parse(*publicUrl) // Checked by parseConfig
+		return u.Scheme
+	}
 	if r.TLS != nil {
-		scheme = "https"
+		return "https"
+	}
+	return "http"
+}
+
+type errorResponse struct {
+	Error   string   `json:"error"`
+	Details []string `json:"details,omitempty"`
+}
+
+// problemDetails is an RFC 7807 error, sent instead of errorResponse when
+// -problem-json is set.
+type problemDetails struct {
+	Type     string   `json:"type"`
+	Title    string   `json:"title"`
+	Status   int      `json:"status"`
+	Detail   string   `json:"detail,omitempty"`
+	Instance string   `json:"instance,omitempty"`
+	Errors   []string `json:"errors,omitempty"`
+}
+
+// writeError sends an error as a JSON object in the style of http.Error.
+func writeError(w http.ResponseWriter, r *http.Request, error string, code int) {
+	writeErrorDetails(w, r, error, code, nil)
+}
+
+func writeErrorDetails(w http.ResponseWriter, r *http.Request, error string, code int, details []string) {
+	noteDenial(r.Context(), error)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if *problemJson {
+		w.Header().Set("Content-Type", "application/problem+json; charset=UTF-8")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(problemDetails{
+			Type:     "about:blank",
+			Title:    http.StatusText(code),
+			Status:   code,
+			Detail:   error,
+			Instance: r.URL.Path,
+			Errors:   details,
+		})
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(code)
+	if *envelopeMode {
+		writeEnvelopeErrors(w, error, code, details)
+		return
+	}
+	json.NewEncoder(w).Encode(errorResponse{Error: error, Details: details})
+}
+
+// decodeBody reads the JSON request body into v, checking it against schema
+// when validation is enabled. It writes an error response and returns false
+// if the body is missing, malformed or invalid.
+func decodeBody(w http.ResponseWriter, r *http.Request, v interface{}, schema *jsonSchema) bool {
+	body, err := io.ReadAll(r.Body)
+	if maxErr := (*http.MaxBytesError)(nil); errors.As(err, &maxErr) {
+		writeError(w, r, fmt.Sprintf("request body is over the %d byte limit", maxErr.Limit), http.StatusRequestEntityTooLarge)
+		return false
+	}
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		writeError(w, r, "request body is required", http.StatusBadRequest)
+		return false
+	}
+
+	violations, err := checkSchema(body, schema)
+	if err != nil {
+		writeError(w, r, err.Error(), errorStatus(decodeError(err)))
+		return false
+	}
+	if len(violations) > 0 {
+		writeErrorDetails(w, r, "request body does not match schema", 422, violations)
+		return false
+	}
+
+	if err := json.Unmarshal(body, v); err != nil {
+		writeError(w, r, err.Error(), errorStatus(decodeError(err)))
+		return false
+	}
+	return true
+}
+
+// mergePatch applies a PATCH body over a copy of the stored todo, so the
+// fields it leaves out keep their stored values. The copy's version is only
+// set if the patch gives one, for the save to check.
+func mergePatch(stored *Todo, patch json.RawMessage) (*Todo, error) {
+	todo := stored.clone()
+	todo.Version = 0
+	todo.Meta = nil // Decoding into the stored map would merge its keys
+	if err := json.Unmarshal(patch, todo); err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(patch, &fields) == nil && fields["meta"] == nil {
+		todo.Meta = maps.Clone(stored.Meta)
+	}
+	return todo, nil
+}
+
+// checkSchema returns how a JSON body breaks schema, if schemas are being
+// validated, or an error if it isn't JSON.
+func checkSchema(body []byte, schema *jsonSchema) ([]string, error) {
+	if !*validateSchema {
+		return nil, nil
+	}
+	var raw interface{}
+	d := json.NewDecoder(bytes.NewReader(body))
+	d.UseNumber()
+	if err := d.Decode(&raw); err != nil {
+		return nil, err
+	}
+	return schema.validate(raw), nil
+}
+
+// parseFilter reads a TodoFilter from the ?completed=, ?tag= and
+// ?meta.<key>= parameters, refusing filters -filterable-fields doesn't allow.
+func parseFilter(r *http.Request) (TodoFilter, error) {
+	var filter TodoFilter
+	if err := checkFilters(r); err != nil {
+		return filter, err
+	}
+	query := r.URL.Query()
+	if completed := query.Get("completed"); completed != "" {
+		b, err := strconv.ParseBool(completed)
+		if err != nil {
+			return filter, fmt.Errorf("Invalid completed filter %q", completed)
+		}
+		filter.Completed = &b
+	}
+	filter.Tag = query.Get("tag")
+	for name := range query {
+		if key, ok := strings.CutPrefix(name, metaFilterPrefix); ok {
+			if key == "" {
+				return filter, fmt.Errorf("Invalid meta filter %q: name a key after %q", name, metaFilterPrefix)
+			}
+			if filter.Meta == nil {
+				filter.Meta = make(map[string]string)
+			}
+			filter.Meta[key] = query.Get(name)
+		}
+	}
+	return filter, nil
+}
+
+// decodeJsonId decodes an id given in a JSON body, which is a number or a
+// string as jsonId writes it.
+func decodeJsonId(raw json.RawMessage) (int, error) {
+	var key string
+	if json.Unmarshal(raw, &key) != nil {
+		key = string(raw) // A number rather than a string
+	}
+	return decodeId(key)
+}
+
+// parseIds reads a comma-separated list of ids, dropping repeats.
+func parseIds(list string) ([]int, error) {
+	keys := strings.Split(list, ",")
+	if len(keys) > *maxIds {
+		return nil, fmt.Errorf("At most %d ids may be requested at once", *maxIds)
+	}
+	ids := make([]int, 0, len(keys))
+	seen := make(map[int]bool)
+	for _, key := range keys {
+		id, err := decodeId(strings.TrimSpace(key))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid Id %q", key)
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// getTodos serves the collection, answering 304 when If-None-Match has the
+// current ETag. With ?wait=<duration> it long-polls: if the ETag given in
+// ?since= (or If-None-Match) is still current it waits up to the duration for
+// a change, answering 304 if none comes, or 503 if the server shuts down.
+func getTodos(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	since := query.Get("since")
+	filter, ferr := parseFilter(r)
+	if ferr != nil {
+		writeError(w, r, ferr.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if wait := query.Get("wait"); wait != "" {
+		timeout, err := time.ParseDuration(wait)
+		if err != nil || timeout < 0 {
+			writeError(w, r, "Invalid wait duration", http.StatusBadRequest)
+			return
+		}
+		if timeout > *maxWait {
+			timeout = *maxWait
+		}
+		if since == "" {
+			since = r.Header.Get("If-None-Match")
+		}
+		_, changed := Changes.current() // Before the version, so no change is missed
+		version, err := storageFor(r).CollectionVersion()
+		if err != nil {
+			writeStorageError(w, r, err)
+			return
+		}
+		if since != "" && sameETag(since, collectionETag(version)) {
+			closing, ok := LongPolls.join()
+			if !ok {
+				w.Header().Set("Retry-After", "1")
+				writeError(w, r, "Server is shutting down", http.StatusServiceUnavailable)
+				return
+			}
+			defer LongPolls.leave()
+			timer := time.NewTimer(timeout)
+			defer timer.Stop()
+			select {
+			case <-changed:
+			case <-timer.C:
+				w.Header().Set("ETag", collectionETag(version))
+				w.WriteHeader(http.StatusNotModified)
+				return
+			case <-closing:
+				w.Header().Set("Retry-After", "1")
+				w.Header().Set("Connection", "close")
+				writeError(w, r, "Server is shutting down", http.StatusServiceUnavailable)
+				return
+			case <-r.Context().Done():
+				return
+			}
+		}
+		since = "" // An ETag, not a timestamp
+	}
+
+	version, err := storageFor(r).CollectionVersion()
+	if err != nil {
+		writeStorageError(w, r, err)
+		return
+	}
+	etag := collectionETag(version)
+	if match := r.Header.Get("If-None-Match"); match != "" && matchesETag(match, etag) {
+		w.Header().Set("ETag", etag)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	// Syncs include deletions so clients can drop their copies, unless
+	// they ask for ?include-deleted=false. Other lists never have them.
+	includeDeleted := true
+	if value := query.Get("include-deleted"); value != "" {
+		b, perr := strconv.ParseBool(value)
+		if perr != nil {
+			writeError(w, r, fmt.Sprintf("Invalid include-deleted %q", value), http.StatusBadRequest)
+			return
+		}
+		if since == "" && query.Get("since-seq") == "" {
+			writeError(w, r, "include-deleted needs ?since= or ?since-seq=", http.StatusBadRequest)
+			return
+		}
+		includeDeleted = b
+	}
+
+	var todos []*Todo
+	if list := query.Get("ids"); list != "" {
+		ids, perr := parseIds(list)
+		if perr != nil {
+			writeError(w, r, perr.Error(), http.StatusBadRequest)
+			return
+		}
+		todos, err = storageFor(r).GetMany(ids)
+	} else if since != "" {
+		t, perr := time.Parse(time.RFC3339, since)
+		if perr != nil {
+			writeError(w, r, "Invalid since timestamp", http.StatusBadRequest)
+			return
+		}
+		todos, err = storageFor(r).GetChangedSince(t)
+		if !includeDeleted {
+			todos = undeletedOnly(todos)
+		}
+	} else if value := query.Get("since-seq"); value != "" {
+		seq, perr := strconv.ParseInt(value, 10, 64)
+		if perr != nil || seq < 0 {
+			writeError(w, r, "Invalid since-seq", http.StatusBadRequest)
+			return
+		}
+		todos, err = storageFor(r).GetChangedAfterSeq(seq)
+		if !includeDeleted {
+			todos = undeletedOnly(todos)
+		}
+	} else {
+		archived := false
+		if value := query.Get("archived"); value != "" {
+			b, perr := strconv.ParseBool(value)
+			if perr != nil {
+				writeError(w, r, fmt.Sprintf("Invalid archived filter %q", value), http.StatusBadRequest)
+				return
+			}
+			archived = b
+		}
+		subtasks := false
+		if value := query.Get("include"); value != "" {
+			if value != "subtasks" {
+				writeError(w, r, fmt.Sprintf("Invalid include %q: only subtasks can be included", value), http.StatusBadRequest)
+				return
+			}
+			subtasks = true
+		}
+		if filter.Tag != "" {
+			todos, err = storageFor(r).GetByTag(filter.Tag)
+		} else {
+			todos, err = storageFor(r).GetAll()
+		}
+		todos = archivedOnly(todos, archived)
+		if !subtasks {
+			todos = topLevelOnly(todos)
+		}
+	}
+	if err != nil {
+		writeStorageError(w, r, err)
+		return
+	}
+	if !filter.IsEmpty() {
+		todos = filtered(todos, filter)
+	}
+	if err := sortTodos(r, todos); err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Accept-Ranges", "items")
+	w.Header().Add("Vary", "Range")
+	w.Header().Add("Access-Control-Expose-Headers", "Accept-Ranges, Content-Range")
+
+	// A Range of items is answered with just those todos, unless there
+	// are none at all, in which case the empty list is the whole of it.
+	offset, limit, ranged, err := itemsRange(r, len(todos))
+	if ranged && len(todos) == 0 {
+		ranged, err = false, nil
+	}
+	if err != nil {
+		w.Header().Set("Content-Range", fmt.Sprintf("items */%d", len(todos)))
+		writeError(w, r, "Range Not Satisfiable", http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	if ranged {
+		total := len(todos)
+		todos = pageOf(todos, offset, limit)
+		prepareTodos(r, todos...)
+		w.Header().Set("Content-Range", fmt.Sprintf("items %d-%d/%d", offset, offset+len(todos)-1, total))
+		setMaxPageSize(w)
+		w.WriteHeader(http.StatusPartialContent)
+		writeJsonMeta(w, todos, envelopeMeta{"total": total, "offset": offset, "limit": limit})
+		return
+	}
+	prepareTodos(r, todos...)
+	writeJsonMeta(w, todos, listMeta(len(todos)))
+}
+
+// headTodos serves HEAD /todos, sending the number of todos in X-Total-Count
+// and the collection ETag without reading the todos themselves. The count is
+// Count's, so it includes archived todos and ignores filters. With the
+// current ETag in If-None-Match it answers 304.
+func headTodos(w http.ResponseWriter, r *http.Request) {
+	version, err := storageFor(r).CollectionVersion()
+	if err != nil {
+		writeStorageError(w, r, err)
+		return
+	}
+	n, err := storageFor(r).Count()
+	if err != nil {
+		writeStorageError(w, r, err)
+		return
+	}
+	etag := collectionETag(version)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("X-Total-Count", strconv.Itoa(n))
+	w.Header().Set("Accept-Ranges", "items")
+	w.Header().Add("Access-Control-Expose-Headers", "ETag, X-Total-Count, Accept-Ranges")
+	if match := r.Header.Get("If-None-Match"); match != "" && matchesETag(match, etag) {
+		w.WriteHeader(http.StatusNotModified)
+	}
+}
+
+// filtered keeps the todos matching filter.
+func filtered(todos []*Todo, filter TodoFilter) []*Todo {
+	kept := todos[:0]
+	for _, todo := range todos {
+		if filter.Matches(todo) {
+			kept = append(kept, todo)
+		}
 	}
-	baseUrl := scheme + "://" + r.Host + "/todos/"
+	return kept
+}
+
+// topLevelOnly keeps the todos that aren't subtasks, in place.
+func topLevelOnly(todos []*Todo) []*Todo {
+	kept := todos[:0]
+	for _, todo := range todos {
+		if todo.ParentId == nil {
+			kept = append(kept, todo)
+		}
+	}
+	return kept
+}
+
+// archivedOnly keeps the todos whose Archived matches archived.
+func archivedOnly(todos []*Todo, archived bool) []*Todo {
+	kept := todos[:0]
+	for _, todo := range todos {
+		if todo.Archived == archived {
+			kept = append(kept, todo)
+		}
+	}
+	return kept
+}
 
+// undeletedOnly leaves out the soft-deleted todos, in place.
+func undeletedOnly(todos []*Todo) []*Todo {
+	kept := todos[:0]
 	for _, todo := range todos {
-		todo.Url = baseUrl + strconv.Itoa(todo.Id)
+		if todo.DeletedAt == nil {
+			kept = append(kept, todo)
+		}
+	}
+	return kept
+}
+
+// validTodo checks a decoded todo against the configured limits, writing a
+// 422 and returning false if it breaks one that is rejected, and adding a
+// Warning for each that is only warned about.
+func validTodo(w http.ResponseWriter, r *http.Request, todo *Todo) bool {
+	warnings, err := checkLimits(todo)
+	if err != nil {
+		writeStorageError(w, r, err)
+		return false
+	}
+	addWarnings(w, warnings)
+	return true
+}
+
+// checkTitle returns ErrTitleTaken if titles must be unique and another todo
+// than except already has this one.
+func checkTitle(r *http.Request, title string, except int) error {
+	if !*uniqueTitles {
+		return nil
+	}
+	taken, err := storageFor(r).ExistsByTitle(title, except)
+	if err == nil && taken {
+		err = ErrTitleTaken
+	}
+	return err
+}
+
+// titleTaken writes a 409 and returns true if checkTitle fails.
+func titleTaken(w http.ResponseWriter, r *http.Request, title string, except int) bool {
+	if err := checkTitle(r, title, except); err != nil {
+		writeStorageError(w, r, err)
+		return true
 	}
+	return false
 }
 
 func todoHandler(w http.ResponseWriter, r *http.Request) {
@@ -45,100 +676,448 @@ func todoHandler(w http.ResponseWriter, r *http.Request) {
 	if len(parts) > 2 {
 		key = parts[2]
 	}
+	if len(parts) == 4 && parts[3] == "restore" {
+		restoreHandler(w, r, key)
+		return
+	}
+	if len(parts) == 4 && parts[3] == "move" {
+		moveHandler(w, r, key)
+		return
+	}
+	if len(parts) == 4 && parts[3] == "history" {
+		historyHandler(w, r, key)
+		return
+	}
+	if len(parts) == 4 && parts[3] == "subtasks" {
+		subtasksHandler(w, r, key)
+		return
+	}
 
 	switch r.Method {
 	case "GET":
 		if len(key) == 0 {
-			todos, err := TodoSvc.GetAll()
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			addUrlToTodos(r, todos...)
-			json.NewEncoder(w).Encode(todos)
+			getTodos(w, r)
 		} else {
-			id, err := strconv.Atoi(key)
+			id, err := decodeId(key)
 			if err != nil {
-				http.Error(w, "Invalid Id", http.StatusBadRequest)
+				writeError(w, r, "Invalid Id", http.StatusBadRequest)
 				return
 			}
-			todo, err := TodoSvc.Get(id)
+			todo, err := storageFor(r).Get(id)
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				writeStorageError(w, r, err)
 				return
 			}
 			if todo == nil {
-				http.NotFound(w, r)
+				writeError(w, r, "Not Found", http.StatusNotFound)
+				return
+			}
+			setTodoETag(w, todo)
+			if match := r.Header.Get("If-None-Match"); match != "" && matchesETag(match, todoETag(todo)) {
+				w.WriteHeader(http.StatusNotModified)
 				return
 			}
-			addUrlToTodos(r, todo)
-			json.NewEncoder(w).Encode(todo)
+			prepareTodos(r, todo)
+			writeJson(w, todo)
+		}
+	case "HEAD":
+		if len(key) > 0 {
+			writeError(w, r, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
 		}
+		headTodos(w, r)
 	case "POST":
 		if len(key) > 0 {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
 
-		todo := Todo{
-			Completed: false,
+		// Clients generating their own ids may send one to create the todo at;
+		// it must be free, just as PUT If-None-Match: * requires.
+		body := struct {
+			Todo
+			Id json.RawMessage `json:"id"`
+		}{
+			Todo: *newTodo(), // For bodies that leave fields out
+		}
+		if !decodeBody(w, r, &body, createTodoSchema) || !validTodo(w, r, &body.Todo) {
+			return
+		}
+		todo := body.Todo
+		if len(body.Id) > 0 && string(body.Id) != "null" {
+			id, err := decodeJsonId(body.Id)
+			if err != nil {
+				writeError(w, r, "Invalid Id", http.StatusBadRequest)
+				return
+			}
+			todo.Id = id
+		}
+		if titleTaken(w, r, todo.Title, todo.Id) {
+			return
+		}
+		if err := storageFor(r).Create(&todo); err != nil {
+			writeStorageError(w, r, err)
+			return
 		}
-		err := json.NewDecoder(r.Body).Decode(&todo)
+		setTodoETag(w, &todo)
+		writeTodo(w, r, http.StatusCreated, &todo)
+	case "PATCH":
+		id, err := decodeId(key)
 		if err != nil {
-			http.Error(w, err.Error(), 422)
+			writeError(w, r, "Invalid Id", http.StatusBadRequest)
+			return
+		}
+		var patch json.RawMessage
+		if !decodeBody(w, r, &patch, updateTodoSchema) {
 			return
 		}
-		err = TodoSvc.Save(&todo)
+
+		stored, err := storageFor(r).Get(id)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeStorageError(w, r, err)
 			return
 		}
-		addUrlToTodos(r, &todo)
-		w.WriteHeader(http.StatusCreated)
-		json.NewEncoder(w).Encode(todo)
-	case "PATCH":
-		id, err := strconv.Atoi(key)
+		conditional := r.Header.Get("If-Match") != ""
+		if !ifMatch(r, stored) {
+			writeError(w, r, "The todo has changed since it was read", http.StatusPreconditionFailed)
+			return
+		}
+		if stored == nil {
+			writeError(w, r, "Not Found", http.StatusNotFound)
+			return
+		}
+		todo, err := mergePatch(stored, patch)
+		if err != nil {
+			writeError(w, r, err.Error(), errorStatus(decodeError(err)))
+			return
+		}
+		if !validTodo(w, r, todo) {
+			return
+		}
+		if conditional {
+			todo.Version = stored.Version // So the save fails if it changes first
+		}
+
+		// A PATCH that changes nothing is answered without writing, so it
+		// doesn't bump the version or wake clients waiting for changes.
+		if sameTodo(stored, todo) && (todo.Version == 0 || todo.Version == stored.Version) {
+			setTodoETag(w, stored)
+			writeTodo(w, r, http.StatusOK, stored)
+			return
+		}
+		if stored.Title != todo.Title && titleTaken(w, r, todo.Title, id) {
+			return
+		}
+
+		err = storageFor(r).Save(todo)
 		if err != nil {
-			http.Error(w, "Invalid Id", http.StatusBadRequest)
+			if err == ErrVersionConflict && conditional {
+				writeError(w, r, "The todo has changed since it was read", http.StatusPreconditionFailed)
+				return
+			}
+			writeStorageError(w, r, err)
 			return
 		}
-		var todo Todo
-		err = json.NewDecoder(r.Body).Decode(&todo)
+		setTodoETag(w, todo)
+		writeTodo(w, r, http.StatusOK, todo)
+	case "PUT":
+		id, err := decodeId(key)
 		if err != nil {
-			http.Error(w, err.Error(), 422)
+			writeError(w, r, "Invalid Id", http.StatusBadRequest)
+			return
+		}
+		// A PUT that creates the todo fills in what the body leaves out
+		// like POST does; one that replaces a todo replaces all of it.
+		var stored *Todo
+		if r.Header.Get("If-None-Match") != "*" {
+			if stored, err = storageFor(r).Get(id); err != nil {
+				writeStorageError(w, r, err)
+				return
+			}
+		}
+		todo := Todo{}
+		if stored == nil {
+			todo = *newTodo()
+		}
+		if !decodeBody(w, r, &todo, createTodoSchema) || !validTodo(w, r, &todo) {
 			return
 		}
 		todo.Id = id
+		conditional := r.Header.Get("If-Match") != ""
+		if conditional {
+			if !ifMatch(r, stored) {
+				writeError(w, r, "The todo has changed since it was read", http.StatusPreconditionFailed)
+				return
+			}
+			todo.Version = stored.Version
+		}
+		if titleTaken(w, r, todo.Title, id) {
+			return
+		}
 
-		err = TodoSvc.Save(&todo)
+		if r.Header.Get("If-None-Match") == "*" { // Create only if absent
+			err = storageFor(r).Create(&todo)
+			if err == ErrAlreadyExists {
+				writeError(w, r, "A todo with this id already exists", http.StatusPreconditionFailed)
+				return
+			}
+			if err != nil {
+				writeStorageError(w, r, err)
+				return
+			}
+			setTodoETag(w, &todo)
+			w.Header().Set("Location", todoUrl(r, todo.Id))
+			writeTodo(w, r, http.StatusCreated, &todo)
+			return
+		}
+
+		created, err := storageFor(r).Upsert(&todo)
 		if err != nil {
-			if strings.ToLower(err.Error()) == "not found" {
-				http.NotFound(w, r)
+			if err == ErrVersionConflict && conditional {
+				writeError(w, r, "The todo has changed since it was read", http.StatusPreconditionFailed)
 				return
 			}
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeStorageError(w, r, err)
 			return
 		}
-		addUrlToTodos(r, &todo)
-		json.NewEncoder(w).Encode(todo)
+		setTodoETag(w, &todo)
+		if created {
+			w.Header().Set("Location", todoUrl(r, todo.Id))
+			writeTodo(w, r, http.StatusCreated, &todo)
+		} else {
+			writeTodo(w, r, http.StatusOK, &todo)
+		}
 	case "DELETE":
 		if len(key) == 0 {
-			TodoSvc.DeleteAll()
-		} else {
-			id, err := strconv.Atoi(key)
+			filter, err := parseFilter(r)
 			if err != nil {
-				http.Error(w, "Invalid Id", http.StatusBadRequest)
+				writeError(w, r, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if !filter.IsEmpty() {
+				n, err := storageFor(r).DeleteWhere(filter)
+				if err != nil {
+					writeStorageError(w, r, err)
+					return
+				}
+				if *deleteResponse == http.StatusOK {
+					writeJson(w, map[string]int{"deleted": n})
+					return
+				}
+				w.WriteHeader(http.StatusNoContent)
 				return
 			}
-			err = TodoSvc.Delete(id)
+			if *deleteResponse == http.StatusOK {
+				// DeleteWhere with an empty filter matches everything and
+				// says how many todos went, which DeleteAll doesn't.
+				n, err := storageFor(r).DeleteWhere(filter)
+				if err != nil {
+					writeStorageError(w, r, err)
+					return
+				}
+				writeJson(w, map[string]int{"deleted": n})
+				return
+			}
+			if err := storageFor(r).DeleteAll(); err != nil {
+				writeStorageError(w, r, err)
+				return
+			}
+		} else {
+			id, err := decodeId(key)
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				writeError(w, r, "Invalid Id", http.StatusBadRequest)
+				return
+			}
+			var todo *Todo
+			if *deleteResponse == http.StatusOK || r.Header.Get("If-Match") != "" {
+				todo, err = storageFor(r).Get(id)
+				if err != nil {
+					writeStorageError(w, r, err)
+					return
+				}
+				// Checked before the delete rather than by it, so a save
+				// in between can still be deleted.
+				if !ifMatch(r, todo) {
+					writeError(w, r, "The todo has changed since it was read", http.StatusPreconditionFailed)
+					return
+				}
+				if todo == nil {
+					writeError(w, r, "Not Found", http.StatusNotFound)
+					return
+				}
+			}
+			if err := storageFor(r).Delete(id); err != nil {
+				writeStorageError(w, r, err)
+				return
+			}
+			if *deleteResponse == http.StatusOK {
+				writeTodo(w, r, http.StatusOK, todo)
 				return
 			}
 		}
 		w.WriteHeader(http.StatusNoContent)
 	default:
-		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		writeError(w, r, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+}
+
+// archiveCompletedHandler archives every completed todo, clearing them from
+// the list without deleting them.
+func archiveCompletedHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, r, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	n, err := storageFor(r).ArchiveCompleted()
+	if err != nil {
+		writeStorageError(w, r, err)
+		return
+	}
+	writeJson(w, map[string]int{"archived": n})
+}
+
+// restoreHandler serves POST /todos/{id}/restore, bringing an archived todo
+// back to the list.
+func restoreHandler(w http.ResponseWriter, r *http.Request, key string) {
+	if r.Method != "POST" {
+		writeError(w, r, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := decodeId(key)
+	if err != nil {
+		writeError(w, r, "Invalid Id", http.StatusBadRequest)
+		return
+	}
+	todo, err := storageFor(r).Get(id)
+	if err != nil {
+		writeStorageError(w, r, err)
+		return
+	}
+	if todo == nil {
+		writeError(w, r, "Not Found", http.StatusNotFound)
+		return
+	}
+	if todo.Archived {
+		todo.Archived = false
+		if err := storageFor(r).Save(todo); err != nil {
+			writeStorageError(w, r, err)
+			return
+		}
+	}
+	prepareTodos(r, todo)
+	writeJson(w, todo)
+}
+
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, r, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	stats, err := storageFor(r).Stats()
+	if err != nil {
+		writeStorageError(w, r, err)
+		return
+	}
+	writeJson(w, stats)
+}
+
+// groupedHandler buckets the todos by ?by=completed ("active" and
+// "completed") or ?by=tag, where a todo appears under each of its tags.
+func groupedHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, r, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	by := r.URL.Query().Get("by")
+	if by != "completed" && by != "tag" {
+		writeError(w, r, `Invalid by: must be "completed" or "tag"`, http.StatusBadRequest)
+		return
+	}
+
+	todos, err := storageFor(r).GetAll()
+	if err != nil {
+		writeStorageError(w, r, err)
+		return
+	}
+	prepareTodos(r, todos...)
+
+	groups := make(map[string][]*Todo)
+	if by == "completed" {
+		groups["active"] = []*Todo{}
+		groups["completed"] = []*Todo{}
+	}
+	for _, todo := range todos {
+		switch {
+		case by == "completed" && todo.Completed:
+			groups["completed"] = append(groups["completed"], todo)
+		case by == "completed":
+			groups["active"] = append(groups["active"], todo)
+		case len(todo.Tags) == 0:
+			groups[untaggedKey] = append(groups[untaggedKey], todo)
+		default:
+			seen := make(map[string]bool)
+			for _, tag := range todo.Tags {
+				if !seen[tag] {
+					seen[tag] = true
+					groups[tag] = append(groups[tag], todo)
+				}
+			}
+		}
+	}
+	writeJson(w, groups)
+}
+
+func tagsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, r, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	tags, err := storageFor(r).TagCounts()
+	if err != nil {
+		writeStorageError(w, r, err)
+		return
+	}
+	writeJsonMeta(w, tags, listMeta(len(tags)))
+}
+
+// renormalizeOrders periodically renumbers todos whose fractional orders have
+// been split so often that there is little room left between them.
+func renormalizeOrders(interval time.Duration, minGap float64) {
+	for range time.Tick(interval) {
+		changed, err := TodoSvc.RenormalizeOrder(minGap)
+		if err != nil {
+			log.Printf("renormalizing order: %v", err)
+		} else if changed {
+			log.Print("renormalized todo order")
+		}
+	}
+}
+
+// purgeDeleted permanently removes todos deleted more than retention ago,
+// checking every interval.
+func purgeDeleted(interval, retention time.Duration) {
+	for range time.Tick(interval) {
+		n, err := TodoSvc.Purge(clock.Now().Add(-retention))
+		if err != nil {
+			log.Printf("purging deleted todos: %v", err)
+		} else if n > 0 {
+			log.Printf("purged %d todos deleted more than %v ago", n, retention)
+		}
+	}
+}
+
+// summaryHandler serves GET /todos/summary, how many todos carry each tag and
+// how many of those are completed.
+func summaryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, r, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	summaries, err := storageFor(r).TagSummaries()
+	if err != nil {
+		writeStorageError(w, r, err)
 		return
 	}
+	writeJsonMeta(w, summaries, listMeta(len(summaries)))
 }
@@ -0,0 +1,545 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestMain configures the server from its defaults, as main does, so the
+// handlers and checks under test see the same settings.
+func TestMain(m *testing.M) {
+	if err := parseConfig(); err != nil {
+		log.Fatal(err)
+	}
+	os.Exit(m.Run())
+}
+
+// useStore points the handlers at a new in-memory store for the test, with
+// an undo history in front of it as main sets up.
+func useStore(t *testing.T) *MockTodoService {
+	store := NewMockTodoService()
+	saved, savedUndoable := TodoSvc, Undoable
+	Undoable = &undoableTodoService{TodoService: store, limit: *undoHistory}
+	TodoSvc = Undoable
+	t.Cleanup(func() { TodoSvc, Undoable = saved, savedUndoable })
+	return store
+}
+
+// send sends a request through the routes under test, with headers given
+// as name, value pairs.
+func send(method, path, body string, headers ...string) *httptest.ResponseRecorder {
+	mux := http.NewServeMux()
+	mux.Handle("/todos", commonHandlers(todoHandler))
+	mux.Handle("/todos/", commonHandlers(todoHandler))
+	mux.Handle("/todos/undo", commonHandlers(undoHandler))
+	mux.Handle("/import", commonHandlers(importHandler))
+	mux.Handle("/rpc", commonHandlers(rpcHandler))
+
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	for i := 0; i+1 < len(headers); i += 2 {
+		r.Header.Set(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	return w
+}
+
+// decodeTodo reads a todo from a response, failing the test if it can't.
+func decodeTodo(t *testing.T, w *httptest.ResponseRecorder) *Todo {
+	t.Helper()
+	var todo Todo
+	if err := json.Unmarshal(w.Body.Bytes(), &todo); err != nil {
+		t.Fatalf("decoding %q: %v", w.Body.String(), err)
+	}
+	return &todo
+}
+
+func TestIdenticalPatchDoesNotWrite(t *testing.T) {
+	fake := NewFakeClock(time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC))
+	store := useStore(t)
+	store.Clock = fake
+
+	if w := send("POST", "/todos", `{"title":"walk the dog","order":2}`); w.Code != http.StatusCreated {
+		t.Fatalf("POST: %d %s", w.Code, w.Body)
+	}
+	fake.Advance(time.Minute)
+	first := send("PATCH", "/todos/1", `{"title":"walk the dog"}`)
+	if first.Code != http.StatusOK {
+		t.Fatalf("PATCH: %d %s", first.Code, first.Body)
+	}
+	before := decodeTodo(t, first)
+
+	fake.Advance(time.Minute)
+	second := send("PATCH", "/todos/1", `{"title":"walk the dog","order":2}`)
+	if second.Code != http.StatusOK {
+		t.Fatalf("identical PATCH: %d %s", second.Code, second.Body)
+	}
+	after := decodeTodo(t, second)
+	if !after.UpdatedAt.Equal(before.UpdatedAt) || after.Version != before.Version {
+		t.Fatalf("identical PATCH wrote the todo: updatedAt %v to %v, version %d to %d",
+			before.UpdatedAt, after.UpdatedAt, before.Version, after.Version)
+	}
+	stored, _ := store.Get(1)
+	if !stored.UpdatedAt.Equal(before.UpdatedAt) {
+		t.Fatalf("stored updatedAt moved to %v", stored.UpdatedAt)
+	}
+}
+
+func TestPostCompleted(t *testing.T) {
+	store := useStore(t)
+	w := send("POST", "/todos", `{"title":"x","completed":true}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("POST: %d %s", w.Code, w.Body)
+	}
+	if todo := decodeTodo(t, w); !todo.Completed || todo.CompletedAt == nil {
+		t.Fatalf("response has completed %v, completedAt %v", todo.Completed, todo.CompletedAt)
+	}
+	if stored, _ := store.Get(1); stored == nil || !stored.Completed {
+		t.Fatalf("stored %+v, want it completed", stored)
+	}
+
+	// With -default-completed the body still decides when it says.
+	defer func(saved Todo) { todoDefaults = saved }(todoDefaults)
+	todoDefaults = Todo{Completed: true}
+	if w := send("POST", "/todos", `{"title":"y"}`); !decodeTodo(t, w).Completed {
+		t.Fatalf("POST without completed under -default-completed: %s", w.Body)
+	}
+	if w := send("POST", "/todos", `{"title":"z","completed":false}`); decodeTodo(t, w).Completed {
+		t.Fatalf("POST with completed false under -default-completed: %s", w.Body)
+	}
+}
+
+// TestPatchRacingDelete hammers one id with PATCHes and a DELETE at once.
+// Run it with -race: each PATCH must either land before the delete or get
+// a 404, and none may write to a todo it didn't look up.
+func TestPatchRacingDelete(t *testing.T) {
+	store := useStore(t)
+	for round := 0; round < 50; round++ {
+		todo := &Todo{Title: "contested"}
+		if err := store.Save(todo); err != nil {
+			t.Fatal(err)
+		}
+		// Others around it, so a shifted index would land on one of them.
+		for i := 0; i < 3; i++ {
+			store.Save(&Todo{Title: "bystander"})
+		}
+		path := "/todos/" + encodeId(todo.Id)
+
+		var wg sync.WaitGroup
+		codes := make(chan int, 21)
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				codes <- send("PATCH", path, fmt.Sprintf(`{"title":"patch %d"}`, i)).Code
+			}(i)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- send("DELETE", path, "").Code
+		}()
+		wg.Wait()
+		close(codes)
+
+		for code := range codes {
+			switch code {
+			case http.StatusOK, http.StatusNoContent, http.StatusNotFound:
+			default:
+				t.Fatalf("round %d: got status %d", round, code)
+			}
+		}
+		if stored, _ := store.Get(todo.Id); stored != nil {
+			t.Fatalf("round %d: the todo outlived its DELETE: %+v", round, stored)
+		}
+	}
+	todos, _ := store.GetAll()
+	for _, todo := range todos {
+		if todo.Title != "bystander" {
+			t.Fatalf("a PATCH landed on todo %d: %+v", todo.Id, todo)
+		}
+	}
+}
+
+// unavailableStore fails every count and DeleteAll as a store behind an
+// open breaker does.
+type unavailableStore struct {
+	*MockTodoService
+}
+
+func (unavailableStore) Count() (int, error) {
+	return 0, ErrCircuitOpen
+}
+
+func (unavailableStore) DeleteAll() error {
+	return ErrCircuitOpen
+}
+
+func TestHeadTodosStorageError(t *testing.T) {
+	saved := TodoSvc
+	TodoSvc = unavailableStore{NewMockTodoService()}
+	defer func() { TodoSvc = saved }()
+
+	if w := send("HEAD", "/todos", ""); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("HEAD with storage unavailable: got %d, want 503", w.Code)
+	}
+}
+
+func TestDeleteAllStorageError(t *testing.T) {
+	saved := TodoSvc
+	TodoSvc = unavailableStore{NewMockTodoService()}
+	defer func() { TodoSvc = saved }()
+
+	if w := send("DELETE", "/todos", ""); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("DELETE /todos with storage unavailable: got %d, want 503", w.Code)
+	}
+}
+
+func TestPatchWithStaleETag(t *testing.T) {
+	store := useStore(t)
+	if err := store.Save(&Todo{Title: "draft"}); err != nil {
+		t.Fatal(err)
+	}
+	etag := send("GET", "/todos/1", "").Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("GET sent no ETag")
+	}
+
+	first := send("PATCH", "/todos/1", `{"title":"first edit"}`, "If-Match", etag)
+	if first.Code != http.StatusOK {
+		t.Fatalf("PATCH with the current ETag: %d %s", first.Code, first.Body)
+	}
+	if first.Header().Get("ETag") == etag {
+		t.Fatal("the ETag didn't change with the todo")
+	}
+	second := send("PATCH", "/todos/1", `{"title":"second edit"}`, "If-Match", etag)
+	if second.Code != http.StatusPreconditionFailed {
+		t.Fatalf("PATCH with a stale ETag: got %d, want 412", second.Code)
+	}
+	if stored, _ := store.Get(1); stored.Title != "first edit" {
+		t.Fatalf("the stale PATCH was saved: %+v", stored)
+	}
+}
+
+// TestOrderRoundTrip follows the Todo-Backend spec suite's order checks: a
+// todo created with an order is fetched with it, and a PATCH of just the
+// order changes it and nothing else.
+func TestOrderRoundTrip(t *testing.T) {
+	useStore(t)
+	created := send("POST", "/todos", `{"title":"order me","completed":true,"order":523}`)
+	if created.Code != http.StatusCreated {
+		t.Fatalf("POST: %d %s", created.Code, created.Body)
+	}
+	todo := decodeTodo(t, created)
+	if todo.Order != 523 {
+		t.Fatalf("created todo has order %v, want 523", todo.Order)
+	}
+	path := strings.TrimPrefix(todo.Url, "http://example.com")
+	if path != "/todos/1" {
+		t.Fatalf("created todo has url %q", todo.Url)
+	}
+	if fetched := decodeTodo(t, send("GET", path, "")); fetched.Order != 523 {
+		t.Fatalf("fetched todo has order %v, want 523", fetched.Order)
+	}
+
+	if w := send("PATCH", path, `{"order":95}`); w.Code != http.StatusOK {
+		t.Fatalf("PATCH of the order: %d %s", w.Code, w.Body)
+	}
+	fetched := decodeTodo(t, send("GET", path, ""))
+	if fetched.Order != 95 || fetched.Title != "order me" || !fetched.Completed {
+		t.Fatalf("after a PATCH of the order the todo is %q, completed %v, order %v",
+			fetched.Title, fetched.Completed, fetched.Order)
+	}
+}
+
+// deletedFirstStore deletes each todo just before saving it, as a DELETE
+// landing between a PATCH's read and its write would.
+type deletedFirstStore struct {
+	*MockTodoService
+}
+
+func (s deletedFirstStore) Save(todo *Todo) error {
+	s.MockTodoService.Delete(todo.Id)
+	return s.MockTodoService.Save(todo)
+}
+
+func TestPatchUnknownId(t *testing.T) {
+	useStore(t)
+	if w := send("PATCH", "/todos/99", `{"title":"nobody"}`); w.Code != http.StatusNotFound {
+		t.Fatalf("PATCH of an unknown id: got %d, want 404", w.Code)
+	}
+
+	// Deleted after the PATCH read it, so it is Save that finds it gone.
+	store := NewMockTodoService()
+	if err := store.Save(&Todo{Title: "doomed"}); err != nil {
+		t.Fatal(err)
+	}
+	TodoSvc = deletedFirstStore{store}
+	if w := send("PATCH", "/todos/1", `{"title":"too late"}`); w.Code != http.StatusNotFound {
+		t.Fatalf("PATCH of a todo deleted before the write: got %d, want 404", w.Code)
+	}
+}
+
+func TestBodyErrorStatus(t *testing.T) {
+	useStore(t)
+	if err := TodoSvc.Save(&Todo{Title: "existing"}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		method, path, body string
+		want               int
+		schemaOnly         bool // Only the schema rejects it
+	}{
+		{"POST", "/todos", `not json`, http.StatusBadRequest, false},
+		{"POST", "/todos", `{"title":`, http.StatusBadRequest, false},
+		{"POST", "/todos", `{"title":""}`, 422, true},
+		{"POST", "/todos", `{"title":5}`, 422, false},
+		{"PATCH", "/todos/1", `not json`, http.StatusBadRequest, false},
+		{"PATCH", "/todos/1", `{"title":""}`, 422, true},
+		{"PATCH", "/todos/1", `{"order":"first"}`, 422, false},
+		{"PUT", "/todos/1", `{"title":`, http.StatusBadRequest, false},
+		{"PUT", "/todos/1", `{"title":""}`, 422, true},
+	}
+	// The schemas catch a wrong type first; without them decoding does.
+	defer func(validate bool) { *validateSchema = validate }(*validateSchema)
+	for _, validate := range []bool{true, false} {
+		*validateSchema = validate
+		for _, tt := range tests {
+			if tt.schemaOnly && !validate {
+				continue
+			}
+			if w := send(tt.method, tt.path, tt.body); w.Code != tt.want {
+				t.Errorf("-validate-schema=%v %s %s %s: got %d, want %d: %s",
+					validate, tt.method, tt.path, tt.body, w.Code, tt.want, w.Body)
+			}
+		}
+	}
+}
+
+func TestSinceIncludesDeletions(t *testing.T) {
+	start := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	fake := NewFakeClock(start)
+	store := useStore(t)
+	store.Clock = fake
+	for _, title := range []string{"kept", "deleted"} {
+		if err := store.Save(&Todo{Title: title}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fake.Advance(time.Hour)
+	since := fake.Now().Format(time.RFC3339)
+	if w := send("DELETE", "/todos/2", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("DELETE: %d %s", w.Code, w.Body)
+	}
+
+	list := func(query string) []*Todo {
+		t.Helper()
+		w := send("GET", "/todos?"+query, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET /todos?%s: %d %s", query, w.Code, w.Body)
+		}
+		var todos []*Todo
+		if err := json.Unmarshal(w.Body.Bytes(), &todos); err != nil {
+			t.Fatal(err)
+		}
+		return todos
+	}
+	synced := list("since=" + since)
+	if len(synced) != 1 || synced[0].Title != "deleted" || synced[0].DeletedAt == nil {
+		t.Fatalf("?since= returned %+v, want just the deleted todo with deletedAt", synced)
+	}
+	if live := list("since=" + since + "&include-deleted=false"); len(live) != 0 {
+		t.Fatalf("?include-deleted=false returned %+v, want nothing", live)
+	}
+	if all := list(""); len(all) != 1 || all[0].Title != "kept" {
+		t.Fatalf("GET /todos returned %+v, want only the kept todo", all)
+	}
+}
+
+func TestFilteredDeleteResponse(t *testing.T) {
+	defer func(status int) { *deleteResponse = status }(*deleteResponse)
+	for _, status := range []int{http.StatusNoContent, http.StatusOK} {
+		*deleteResponse = status
+		store := useStore(t)
+		for _, completed := range []bool{true, false} {
+			if err := store.Save(&Todo{Title: "todo", Completed: completed}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		w := send("DELETE", "/todos?completed=true", "")
+		if w.Code != status {
+			t.Fatalf("-delete-response=%d: got %d %s", status, w.Code, w.Body)
+		}
+		if want := map[int]string{http.StatusNoContent: "", http.StatusOK: `{"deleted":1}`}[status]; strings.TrimSpace(w.Body.String()) != want {
+			t.Fatalf("-delete-response=%d: body %q, want %q", status, w.Body, want)
+		}
+	}
+}
+
+// TestStaleAfterRecreate checks that putting a deleted todo back, by undoing
+// the delete or by a PUT at its id, doesn't take its version back to one
+// an old copy of it has.
+func TestStaleAfterRecreate(t *testing.T) {
+	recreate := map[string]func(t *testing.T){
+		"undo": func(t *testing.T) {
+			if w := send("POST", "/todos/undo", ""); w.Code != http.StatusOK {
+				t.Fatalf("undo: %d %s", w.Code, w.Body)
+			}
+		},
+		"put": func(t *testing.T) {
+			if w := send("PUT", "/todos/1", `{"title":"again"}`, "If-None-Match", "*"); w.Code != http.StatusCreated {
+				t.Fatalf("PUT If-None-Match: *: %d %s", w.Code, w.Body)
+			}
+		},
+	}
+	for name, recreate := range recreate {
+		t.Run(name, func(t *testing.T) {
+			store := useStore(t)
+
+			w := send("POST", "/todos", `{"title":"first"}`)
+			if w.Code != http.StatusCreated {
+				t.Fatalf("POST: %d %s", w.Code, w.Body)
+			}
+			etag := w.Header().Get("ETag")
+			for _, title := range []string{"second", "third"} {
+				if w := send("PATCH", "/todos/1", `{"title":"`+title+`"}`); w.Code != http.StatusOK {
+					t.Fatalf("PATCH: %d %s", w.Code, w.Body)
+				}
+			}
+			if w := send("DELETE", "/todos/1", ""); w.Code != http.StatusNoContent {
+				t.Fatalf("DELETE: %d %s", w.Code, w.Body)
+			}
+			recreate(t)
+
+			if w := send("PATCH", "/todos/1", `{"title":"stale","version":1}`); w.Code != http.StatusConflict {
+				t.Errorf("PATCH with the first version: got %d, want 409", w.Code)
+			}
+			if w := send("PATCH", "/todos/1", `{"title":"stale"}`, "If-Match", etag); w.Code != http.StatusPreconditionFailed {
+				t.Errorf("PATCH with the first ETag: got %d, want 412", w.Code)
+			}
+			if stored, _ := store.Get(1); stored == nil || stored.Title == "stale" || stored.Version <= 3 {
+				t.Fatalf("stored %+v, want the put back todo past version 3", stored)
+			}
+		})
+	}
+}
+
+// TestFailedImportLeavesNothingToUndo checks that the todos a failed import
+// rolls back aren't left for undo to bring back: those of the failing batch,
+// and with ?mode=atomic those of earlier batches too.
+func TestFailedImportLeavesNothingToUndo(t *testing.T) {
+	defer func(size int) { *importBatchSize = size }(*importBatchSize)
+	for mode, batchSize := range map[string]int{"batch": 10, "atomic": 1} {
+		t.Run(mode, func(t *testing.T) {
+			*importBatchSize = batchSize
+			store := useStore(t)
+			store.OrderMode = OrderReject
+			if err := store.Save(&Todo{Title: "existing", Order: 5}); err != nil { // Not recorded
+				t.Fatal(err)
+			}
+
+			w := send("POST", "/import?mode="+mode, `[{"title":"a"},{"title":"b"},{"title":"c","order":5}]`)
+			if w.Code != http.StatusConflict {
+				t.Fatalf("import: got %d %s, want 409", w.Code, w.Body)
+			}
+			if w := send("POST", "/todos/undo", ""); w.Code != http.StatusConflict {
+				t.Fatalf("undo after the failed import: got %d %s, want 409", w.Code, w.Body)
+			}
+			if live, _ := store.GetAll(); len(live) != 1 {
+				t.Fatalf("left %d todos, want just the existing one", len(live))
+			}
+		})
+	}
+}
+
+// TestImportUniqueTitles checks that imports keep -unique-titles, against the
+// stored todos and among the imported ones.
+func TestImportUniqueTitles(t *testing.T) {
+	defer func(unique bool) { *uniqueTitles = unique }(*uniqueTitles)
+	*uniqueTitles = true
+	store := useStore(t)
+	if err := store.Save(&Todo{Title: "existing"}); err != nil {
+		t.Fatal(err)
+	}
+	w := send("POST", "/import?mode=partial", `[{"title":"Existing"},{"title":"new"},{"title":"NEW"}]`)
+	if w.Code != http.StatusMultiStatus {
+		t.Fatalf("partial import: %d %s", w.Code, w.Body)
+	}
+	var report importReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	var statuses []int
+	for _, result := range report.Results {
+		statuses = append(statuses, result.Status)
+	}
+	if want := []int{409, 201, 409}; !slices.Equal(statuses, want) {
+		t.Fatalf("partial import statuses %v, want %v", statuses, want)
+	}
+
+	for _, mode := range []string{"batch", "atomic"} {
+		store := useStore(t)
+		if w := send("POST", "/import?mode="+mode, `[{"title":"new"},{"title":"NEW"}]`); w.Code != http.StatusConflict {
+			t.Fatalf("%s import with a repeated title: got %d %s, want 409", mode, w.Code, w.Body)
+		}
+		if live, _ := store.GetAll(); len(live) != 0 {
+			t.Fatalf("%s import left %d todos", mode, len(live))
+		}
+	}
+}
+
+// TestPutDefaults checks that a PUT creating a todo gets the defaults a POST
+// would, and one replacing a todo doesn't.
+func TestPutDefaults(t *testing.T) {
+	defer func(saved Todo) { todoDefaults = saved }(todoDefaults)
+	todoDefaults = Todo{Completed: true, Notes: "default"}
+	useStore(t)
+
+	for _, headers := range [][]string{nil, {"If-None-Match", "*"}} {
+		path := fmt.Sprintf("/todos/%d", 10+len(headers))
+		w := send("PUT", path, `{"title":"new"}`, headers...)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("PUT %s %v: %d %s", path, headers, w.Code, w.Body)
+		}
+		if todo := decodeTodo(t, w); !todo.Completed || todo.Notes != "default" {
+			t.Fatalf("PUT %s %v created %+v, want the defaults", path, headers, todo)
+		}
+	}
+	w := send("PUT", "/todos/10", `{"title":"replaced"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("PUT replacing: %d %s", w.Code, w.Body)
+	}
+	if todo := decodeTodo(t, w); todo.Completed || todo.Notes != "" {
+		t.Fatalf("PUT replacing gave %+v, want the defaults left out", todo)
+	}
+}
+
+// TestAtomicImportRejectLeavesNothingToUndo rolls back an atomic import
+// because of an invalid todo rather than a failed save, after earlier
+// batches were saved.
+func TestAtomicImportRejectLeavesNothingToUndo(t *testing.T) {
+	defer func(size int) { *importBatchSize = size }(*importBatchSize)
+	*importBatchSize = 1
+	store := useStore(t)
+
+	w := send("POST", "/import?mode=atomic", `[{"title":"a"},{"title":"b"},{"title":""}]`)
+	if w.Code != 422 || !strings.Contains(w.Body.String(), "no todos were imported") {
+		t.Fatalf("import: got %d %s, want 422 with nothing imported", w.Code, w.Body)
+	}
+	if w := send("POST", "/todos/undo", ""); w.Code != http.StatusConflict {
+		t.Fatalf("undo after the failed import: got %d %s, want 409", w.Code, w.Body)
+	}
+	if live, _ := store.GetAll(); len(live) != 0 {
+		t.Fatalf("left %d todos, want none", len(live))
+	}
+}
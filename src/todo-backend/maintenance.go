@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// maintenanceStart and maintenanceEnd are the parsed -maintenance-start and
+// -maintenance-end; either may be zero.
+var maintenanceStart, maintenanceEnd time.Time
+
+// maintenanceNotice describes upcoming maintenance for clients to show.
+type maintenanceNotice struct {
+	Notice string     `json:"notice"`
+	Start  *time.Time `json:"start,omitempty"`
+	End    *time.Time `json:"end,omitempty"`
+}
+
+// currentMaintenance returns the configured notice, or nil if there is none
+// or its window has ended.
+func currentMaintenance() *maintenanceNotice {
+	if *maintenanceMessage == "" || (!maintenanceEnd.IsZero() && clock.Now().After(maintenanceEnd)) {
+		return nil
+	}
+	notice := &maintenanceNotice{Notice: *maintenanceMessage}
+	if !maintenanceStart.IsZero() {
+		notice.Start = &maintenanceStart
+	}
+	if !maintenanceEnd.IsZero() {
+		notice.End = &maintenanceEnd
+	}
+	return notice
+}
+
+// announceMaintenance adds an X-Maintenance header with the notice, and
+// X-Maintenance-Window with its times, to every response until the window
+// ends, exposing them to browser scripts. Nothing else about the response
+// changes.
+func announceMaintenance(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if notice := currentMaintenance(); notice != nil {
+			w.Header().Set("X-Maintenance", notice.Notice)
+			w.Header().Add("Access-Control-Expose-Headers", "X-Maintenance, X-Maintenance-Window")
+			if notice.Start != nil || notice.End != nil {
+				window := ""
+				if notice.Start != nil {
+					window = notice.Start.Format(time.RFC3339)
+				}
+				window += "/"
+				if notice.End != nil {
+					window += notice.End.Format(time.RFC3339)
+				}
+				w.Header().Set("X-Maintenance-Window", window)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
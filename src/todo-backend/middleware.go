@@ -1,15 +1,31 @@
 package main
 
 import (
+	"compress/gzip"
+	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 func cors(next http.Handler) http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("access-control-allow-origin", "*")
-		w.Header().Set("access-control-allow-methods", "GET, POST, PATCH, DELETE")
-		w.Header().Set("access-control-allow-headers", "accept, content-type")
+		w.Header().Set("access-control-allow-methods", "GET, HEAD, POST, PUT, PATCH, DELETE")
+		w.Header().Set("access-control-allow-headers", "accept, content-type, content-encoding, if-match, if-none-match, x-timezone, x-request-id, prefer, range, x-describe, x-default-page-size")
 		if r.Method == "OPTIONS" {
+			// Let browsers cache the preflight rather than repeat it
+			w.Header().Set("access-control-max-age", strconv.Itoa(int(corsMaxAge.Seconds())))
+			if resource := describedResource(r.URL.Path); resource != "" && wantsDescription(r) {
+				describe(w, resource)
+			}
 			return // Preflight sets headers and we're done
 		}
 		next.ServeHTTP(w, r)
@@ -27,6 +43,385 @@ func contentTypeJsonHandler(next http.Handler) http.Handler {
 	return http.HandlerFunc(fn)
 }
 
+// gzipResponseWriter compresses the body, starting the gzip stream on the
+// first write so bodiless responses (204s) stay empty.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz *gzip.Writer
+}
+
+func (g *gzipResponseWriter) WriteHeader(status int) {
+	if status != http.StatusNoContent && status != http.StatusNotModified {
+		g.start()
+	}
+	g.ResponseWriter.WriteHeader(status)
+}
+
+func (g *gzipResponseWriter) Write(b []byte) (int, error) {
+	g.start()
+	return g.gz.Write(b)
+}
+
+func (g *gzipResponseWriter) start() {
+	if g.gz == nil {
+		g.Header().Del("Content-Length")
+		g.Header().Set("Content-Encoding", "gzip")
+		g.gz, _ = gzip.NewWriterLevel(g.ResponseWriter, *gzipLevel) // Level is validated at startup
+	}
+}
+
+func (g *gzipResponseWriter) Close() error {
+	if g.gz == nil {
+		return nil
+	}
+	return g.gz.Close()
+}
+
+// FlushError lets http.ResponseController flush what has been compressed.
+func (g *gzipResponseWriter) FlushError() error {
+	if g.gz != nil {
+		if err := g.gz.Flush(); err != nil {
+			return err
+		}
+	}
+	return http.NewResponseController(g.ResponseWriter).Flush()
+}
+
+func gzipHandler(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		defer gw.Close()
+		next.ServeHTTP(gw, r)
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+// acceptsGzip reports whether an Accept-Encoding header allows a gzipped
+// response: gzip, or failing that *, listed with a q-value above zero.
+func acceptsGzip(header string) bool {
+	gzipQ, anyQ := -1.0, -1.0
+	for _, coding := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(coding, ";")
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			key, value, _ := strings.Cut(param, "=")
+			if strings.EqualFold(strings.TrimSpace(key), "q") {
+				var err error
+				if q, err = strconv.ParseFloat(strings.TrimSpace(value), 64); err != nil {
+					q = 0
+				}
+			}
+		}
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "gzip", "x-gzip":
+			gzipQ = q
+		case "*":
+			anyQ = q
+		}
+	}
+	if gzipQ >= 0 {
+		return gzipQ > 0
+	}
+	return anyQ > 0
+}
+
+// decodeRequestBody caps request bodies at -max-body-size and decompresses
+// gzipped ones, applying the cap to the decompressed size as well so a small
+// upload can't expand without limit. Other encodings get a 415.
+func decodeRequestBody(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		switch strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))) {
+		case "", "identity":
+		case "gzip", "x-gzip":
+			zr, err := gzip.NewReader(http.MaxBytesReader(w, r.Body, bodyLimit(r)))
+			if err != nil {
+				writeError(w, r, "Invalid gzip request body", http.StatusBadRequest)
+				return
+			}
+			defer zr.Close()
+			r.Body = zr
+			r.Header.Del("Content-Encoding")
+			r.ContentLength = -1
+		default:
+			w.Header().Set("Accept-Encoding", "gzip")
+			writeError(w, r, "Unsupported Content-Encoding, only gzip is accepted", http.StatusUnsupportedMediaType)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, bodyLimit(r))
+		next.ServeHTTP(w, r)
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+// bodyLimit is the largest body r may have: -max-body-size, or for imports
+// -max-import-size.
+func bodyLimit(r *http.Request) int64 {
+	if r.URL.Path == "/import" {
+		return *maxImportSize
+	}
+	return *maxBodySize
+}
+
+// statusRecorder remembers the status code written through it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+var requestCount uint64
+
+// shouldLog applies the -log-* sampling settings. Server errors are always
+// logged; other requests must pass every enabled filter.
+func shouldLog(status int, elapsed time.Duration) bool {
+	if status >= 500 {
+		return true
+	}
+	if *logNon2xxOnly && status >= 200 && status < 300 {
+		return false
+	}
+	if *logSlowerThan > 0 && elapsed < *logSlowerThan {
+		return false
+	}
+	if *logSample > 1 && atomic.AddUint64(&requestCount, 1)%uint64(*logSample) != 0 {
+		return false
+	}
+	return *logSample > 0
+}
+
+// redactedParams holds the lower-cased -log-redact names.
+var redactedParams map[string]bool
+
+// redactedURI is the request URI with the values of -log-redact parameters
+// replaced by ***. The rest of the query is left as sent.
+func redactedURI(u *url.URL) string {
+	if u.RawQuery == "" || len(redactedParams) == 0 {
+		return u.RequestURI()
+	}
+	params := strings.Split(u.RawQuery, "&")
+	for i, param := range params {
+		raw, _, hasValue := strings.Cut(param, "=")
+		name, err := url.QueryUnescape(raw)
+		if err != nil {
+			name = raw
+		}
+		if hasValue && redactedParams[strings.ToLower(name)] {
+			params[i] = raw + "=***"
+		}
+	}
+	redacted := *u
+	redacted.RawQuery = strings.Join(params, "&")
+	return redacted.RequestURI()
+}
+
+// recoverPanics turns a panic in a handler into a logged stack trace and a
+// 500. With -panic-mode=dev it exits the process instead, so bugs can't go
+// unnoticed behind a recovered error.
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if p == http.ErrAbortHandler {
+				panic(p) // A deliberate abort, left to net/http
+			}
+			log.Printf("panic serving %s %s request=%s: %v\n%s", r.Method, r.URL.Path, requestId(r.Context()), p, debug.Stack())
+			if *panicMode == "dev" {
+				os.Exit(2)
+			}
+			writeError(w, r, "Internal Server Error", http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+func loggingHandler(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		elapsed := time.Since(start)
+		if shouldLog(rec.status, elapsed) {
+			log.Printf("%s %s %d %v request=%s", r.Method, redactedURI(r.URL), rec.status, elapsed, requestId(r.Context()))
+		}
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+func isHealthCheck(r *http.Request) bool {
+	return r.URL.Path == "/healthz" || r.URL.Path == "/readyz"
+}
+
+// shedLoad limits how many requests are handled at once. Beyond the limit a
+// request waits up to queueTimeout for a slot, or with no timeout is turned
+// away at once, with a 503. Health checks are never limited.
+func shedLoad(limit int, queueTimeout time.Duration, next http.Handler) http.Handler {
+	if limit <= 0 {
+		return next
+	}
+	slots := make(chan struct{}, limit)
+
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if isHealthCheck(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		select {
+		case slots <- struct{}{}:
+		default:
+			if queueTimeout <= 0 {
+				overloaded(w, r)
+				return
+			}
+			timer := time.NewTimer(queueTimeout)
+			defer timer.Stop()
+			select {
+			case slots <- struct{}{}:
+			case <-timer.C:
+				overloaded(w, r)
+				return
+			case <-r.Context().Done():
+				return
+			}
+		}
+		defer func() { <-slots }()
+		next.ServeHTTP(w, r)
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+// limitPerClient caps the requests one client IP may have in flight, turning
+// away the excess with a 429 so a single client can't take every connection.
+// Clients are forgotten as soon as they have nothing in flight.
+func limitPerClient(limit int, next http.Handler) http.Handler {
+	if limit <= 0 {
+		return next
+	}
+	var m sync.Mutex
+	inFlight := make(map[string]int)
+
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if isHealthCheck(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		client := clientIP(r)
+		m.Lock()
+		if inFlight[client] >= limit {
+			m.Unlock()
+			w.Header().Set("Retry-After", "1")
+			writeError(w, r, "Too many concurrent requests", http.StatusTooManyRequests)
+			return
+		}
+		inFlight[client]++
+		m.Unlock()
+
+		defer func() {
+			m.Lock()
+			if inFlight[client]--; inFlight[client] == 0 {
+				delete(inFlight, client)
+			}
+			m.Unlock()
+		}()
+		next.ServeHTTP(w, r)
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func overloaded(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Retry-After", "1")
+	writeError(w, r, "Server is overloaded, try again shortly", http.StatusServiceUnavailable)
+}
+
+// canonicalize redirects requests whose Host isn't host, ignoring case, to
+// the same path there with a 308, so clients repeat the method and body.
+// Health checks, which probes send to whatever address they reach, are
+// answered where they arrive.
+func canonicalize(host string, next http.Handler) http.Handler {
+	if host == "" {
+		return next
+	}
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if strings.EqualFold(r.Host, host) || isHealthCheck(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		target := r.RequestURI // As sent, before stripPrefix
+		if !strings.HasPrefix(target, "/") {
+			target = r.URL.RequestURI()
+		}
+		http.Redirect(w, r, publicScheme(r)+"://"+host+target, http.StatusPermanentRedirect)
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+// stripPrefix removes prefix from the request path when present, so routing
+// works whether or not a proxy in front has already rewritten it away.
+func stripPrefix(prefix string, next http.Handler) http.Handler {
+	if prefix == "" {
+		return next
+	}
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != prefix && !strings.HasPrefix(r.URL.Path, prefix+"/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.URL = new(url.URL)
+		*r2.URL = *r.URL
+		r2.URL.Path = strings.TrimPrefix(r.URL.Path, prefix)
+		r2.URL.RawPath = strings.TrimPrefix(r.URL.RawPath, prefix)
+		next.ServeHTTP(w, r2)
+	}
+
+	return http.HandlerFunc(fn)
+}
+
 func commonHandlers(next http.HandlerFunc) http.Handler {
-	return contentTypeJsonHandler(cors(next))
+	return gzipHandler(contentTypeJsonHandler(cors(clientZone(decodeRequestBody(next)))))
 }
@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := []struct {
+		header string
+		ok     bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"GZIP", true},
+		{"deflate, gzip;q=0.5", true},
+		{"gzip;q=0", false},
+		{"gzip; q=0.000", false},
+		{"x-gzip-foo", false},
+		{"notgzip", false},
+		{"*", true},
+		{"*;q=0", false},
+		// An explicit gzip entry wins over *
+		{"gzip;q=0, *", false},
+		{"*;q=0, gzip", true},
+		{"gzip;q=nonsense", false},
+	}
+	for _, tt := range tests {
+		if got := acceptsGzip(tt.header); got != tt.ok {
+			t.Errorf("acceptsGzip(%q) = %v, want %v", tt.header, got, tt.ok)
+		}
+	}
+}
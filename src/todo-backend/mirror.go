@@ -0,0 +1,421 @@
+package main
+
+import (
+	"log"
+	"math/rand"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// MirrorTodoService serves everything from a primary store while copying
+// writes to a secondary one, for checking a new backend before migrating to
+// it. A sample of reads is repeated against the secondary and any difference
+// is logged. Secondary failures are logged and never reach the client.
+//
+// The two stores assign their own ids, so the mirror keeps a map from primary
+// to secondary ids. Todos that existed before mirroring started have no
+// mapping and their updates and deletes are not mirrored.
+type MirrorTodoService struct {
+	primary   TodoService
+	secondary TodoService
+	sample    float64 // Fraction of reads compared, 0 to 1
+
+	m   sync.Mutex
+	ids map[int]int
+}
+
+func NewMirrorTodoService(primary, secondary TodoService, sample float64) *MirrorTodoService {
+	return &MirrorTodoService{
+		primary:   primary,
+		secondary: secondary,
+		sample:    sample,
+		ids:       make(map[int]int),
+	}
+}
+
+func (t *MirrorTodoService) sampled() bool {
+	return t.sample > 0 && rand.Float64() < t.sample
+}
+
+func (t *MirrorTodoService) secondaryId(id int) (int, bool) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	sid, ok := t.ids[id]
+	return sid, ok
+}
+
+// sameTodo compares the client-visible fields that both stores should agree on,
+// which are also the ones a PATCH can change.
+func sameTodo(a, b *Todo) bool {
+	return a.Title == b.Title && a.Notes == b.Notes && a.Completed == b.Completed && a.Archived == b.Archived &&
+		a.Order == b.Order && reflect.DeepEqual(a.Tags, b.Tags) && reflect.DeepEqual(a.DueDate, b.DueDate) &&
+		reflect.DeepEqual(a.Meta, b.Meta)
+}
+
+func (t *MirrorTodoService) GetAll() ([]*Todo, error) {
+	todos, err := t.primary.GetAll()
+	if err != nil || !t.sampled() {
+		return todos, err
+	}
+
+	mirrored, serr := t.secondary.GetAll()
+	if serr != nil {
+		log.Printf("mirror: secondary GetAll: %v", serr)
+		return todos, err
+	}
+	if len(mirrored) != len(todos) {
+		log.Printf("mirror: GetAll returned %d todos from primary, %d from secondary", len(todos), len(mirrored))
+	}
+	byId := make(map[int]*Todo, len(mirrored))
+	for _, todo := range mirrored {
+		byId[todo.Id] = todo
+	}
+	for _, todo := range todos {
+		sid, ok := t.secondaryId(todo.Id)
+		if !ok {
+			continue
+		}
+		if other, ok := byId[sid]; !ok {
+			log.Printf("mirror: GetAll: todo %d (secondary %d) missing from secondary", todo.Id, sid)
+		} else if !sameTodo(todo, other) {
+			log.Printf("mirror: GetAll: todo %d differs: primary %+v, secondary %+v", todo.Id, *todo, *other)
+		}
+	}
+	return todos, err
+}
+
+func (t *MirrorTodoService) Get(id int) (*Todo, error) {
+	todo, err := t.primary.Get(id)
+	if err != nil || !t.sampled() {
+		return todo, err
+	}
+	sid, ok := t.secondaryId(id)
+	if !ok {
+		return todo, err
+	}
+
+	other, serr := t.secondary.Get(sid)
+	switch {
+	case serr != nil:
+		log.Printf("mirror: secondary Get(%d): %v", sid, serr)
+	case (todo == nil) != (other == nil):
+		log.Printf("mirror: Get(%d): found in primary %v, in secondary %v", id, todo != nil, other != nil)
+	case todo != nil && !sameTodo(todo, other):
+		log.Printf("mirror: Get(%d) differs: primary %+v, secondary %+v", id, *todo, *other)
+	}
+	return todo, err
+}
+
+// GetMany isn't compared; Get covers the same lookups.
+func (t *MirrorTodoService) GetMany(ids []int) ([]*Todo, error) {
+	return t.primary.GetMany(ids)
+}
+
+// GetByTag isn't compared; TagCounts covers the tag index.
+func (t *MirrorTodoService) GetByTag(tag string) ([]*Todo, error) {
+	return t.primary.GetByTag(tag)
+}
+
+// GetChangedSince isn't compared since the stores stamp their own times.
+func (t *MirrorTodoService) GetChangedSince(since time.Time) ([]*Todo, error) {
+	return t.primary.GetChangedSince(since)
+}
+
+// GetChangedAfterSeq isn't compared since each store numbers its own writes.
+func (t *MirrorTodoService) GetChangedAfterSeq(seq int64) ([]*Todo, error) {
+	return t.primary.GetChangedAfterSeq(seq)
+}
+
+func (t *MirrorTodoService) Snapshot() ([]*Todo, error) {
+	return t.primary.Snapshot()
+}
+
+func (t *MirrorTodoService) ExistsByTitle(title string, except int) (bool, error) {
+	return t.primary.ExistsByTitle(title, except)
+}
+
+// CollectionVersion isn't compared; the stores count their own changes.
+func (t *MirrorTodoService) CollectionVersion() (uint64, error) {
+	return t.primary.CollectionVersion()
+}
+
+func (t *MirrorTodoService) Count() (int, error) {
+	n, err := t.primary.Count()
+	if err != nil || !t.sampled() {
+		return n, err
+	}
+	if sn, serr := t.secondary.Count(); serr != nil {
+		log.Printf("mirror: secondary Count: %v", serr)
+	} else if sn != n {
+		log.Printf("mirror: Count: primary %d, secondary %d", n, sn)
+	}
+	return n, err
+}
+
+func (t *MirrorTodoService) Stats() (TodoStats, error) {
+	stats, err := t.primary.Stats()
+	if err != nil || !t.sampled() {
+		return stats, err
+	}
+	if other, serr := t.secondary.Stats(); serr != nil {
+		log.Printf("mirror: secondary Stats: %v", serr)
+	} else if other != stats {
+		log.Printf("mirror: Stats: primary %+v, secondary %+v", stats, other)
+	}
+	return stats, err
+}
+
+func (t *MirrorTodoService) TagCounts() ([]TagCount, error) {
+	tags, err := t.primary.TagCounts()
+	if err != nil || !t.sampled() {
+		return tags, err
+	}
+	if other, serr := t.secondary.TagCounts(); serr != nil {
+		log.Printf("mirror: secondary TagCounts: %v", serr)
+	} else if !reflect.DeepEqual(tags, other) {
+		log.Printf("mirror: TagCounts: primary %v, secondary %v", tags, other)
+	}
+	return tags, err
+}
+
+// Subtasks isn't compared since the stores stamp their own times.
+func (t *MirrorTodoService) Subtasks(id int) ([]*Todo, error) {
+	return t.primary.Subtasks(id)
+}
+
+func (t *MirrorTodoService) TagSummaries() ([]TagSummary, error) {
+	summaries, err := t.primary.TagSummaries()
+	if err != nil || !t.sampled() {
+		return summaries, err
+	}
+	if other, serr := t.secondary.TagSummaries(); serr != nil {
+		log.Printf("mirror: secondary TagSummaries: %v", serr)
+	} else if !reflect.DeepEqual(summaries, other) {
+		log.Printf("mirror: TagSummaries: primary %v, secondary %v", summaries, other)
+	}
+	return summaries, err
+}
+
+// mapParent points a subtask's shadow at its parent's secondary id,
+// returning false, after logging why, when the parent has none.
+func (t *MirrorTodoService) mapParent(op string, id int, shadow *Todo) bool {
+	if shadow.ParentId == nil {
+		return true
+	}
+	sid, ok := t.secondaryId(int(*shadow.ParentId))
+	if !ok {
+		log.Printf("mirror: %s: the parent of todo %d has no secondary id, not mirrored", op, id)
+		return false
+	}
+	parent := todoRef(sid)
+	shadow.ParentId = &parent
+	return true
+}
+
+func (t *MirrorTodoService) Save(todo *Todo) error {
+	insert := todo.Id == 0
+	if err := t.primary.Save(todo); err != nil {
+		return err
+	}
+
+	shadow := *todo.clone()
+	shadow.Version = 0 // The secondary keeps its own versions
+	if insert {
+		shadow.Id = 0
+	} else {
+		sid, ok := t.secondaryId(todo.Id)
+		if !ok {
+			log.Printf("mirror: Save: todo %d has no secondary id, not mirrored", todo.Id)
+			return nil
+		}
+		shadow.Id = sid
+	}
+	if !t.mapParent("Save", todo.Id, &shadow) {
+		return nil
+	}
+
+	if err := t.secondary.Save(&shadow); err != nil {
+		log.Printf("mirror: secondary Save(%d): %v", shadow.Id, err)
+		return nil
+	}
+	if insert {
+		t.m.Lock()
+		t.ids[todo.Id] = shadow.Id
+		t.m.Unlock()
+	}
+	return nil
+}
+
+func (t *MirrorTodoService) RenormalizeOrder(minGap float64) (bool, error) {
+	changed, err := t.primary.RenormalizeOrder(minGap)
+	if err != nil {
+		return changed, err
+	}
+	if _, serr := t.secondary.RenormalizeOrder(minGap); serr != nil {
+		log.Printf("mirror: secondary RenormalizeOrder: %v", serr)
+	}
+	return changed, nil
+}
+
+// Create mirrors to a fresh secondary id, since the requested one may be
+// taken there.
+func (t *MirrorTodoService) Create(todo *Todo) error {
+	if err := t.primary.Create(todo); err != nil {
+		return err
+	}
+
+	shadow := *todo.clone()
+	shadow.Id = 0
+	if !t.mapParent("Create", todo.Id, &shadow) {
+		return nil
+	}
+	if err := t.secondary.Create(&shadow); err != nil {
+		log.Printf("mirror: secondary Create: %v", err)
+		return nil
+	}
+	t.m.Lock()
+	t.ids[todo.Id] = shadow.Id
+	t.m.Unlock()
+	return nil
+}
+
+func (t *MirrorTodoService) Upsert(todo *Todo) (bool, error) {
+	created, err := t.primary.Upsert(todo)
+	if err != nil {
+		return created, err
+	}
+
+	shadow := *todo.clone()
+	shadow.Version = 0
+	if !t.mapParent("Upsert", todo.Id, &shadow) {
+		return created, nil
+	}
+	if created {
+		shadow.Id = 0
+		if err := t.secondary.Create(&shadow); err != nil {
+			log.Printf("mirror: secondary Create: %v", err)
+			return created, nil
+		}
+		t.m.Lock()
+		t.ids[todo.Id] = shadow.Id
+		t.m.Unlock()
+		return created, nil
+	}
+
+	sid, ok := t.secondaryId(todo.Id)
+	if !ok {
+		log.Printf("mirror: Upsert: todo %d has no secondary id, not mirrored", todo.Id)
+		return created, nil
+	}
+	shadow.Id = sid
+	if err := t.secondary.Save(&shadow); err != nil {
+		log.Printf("mirror: secondary Save(%d): %v", sid, err)
+	}
+	return created, nil
+}
+
+func (t *MirrorTodoService) DeleteAll() error {
+	if err := t.primary.DeleteAll(); err != nil {
+		return err
+	}
+	if err := t.secondary.DeleteAll(); err != nil {
+		log.Printf("mirror: secondary DeleteAll: %v", err)
+	}
+	return nil
+}
+
+// Purge doesn't compare counts since the stores stamp their own deletion
+// times.
+func (t *MirrorTodoService) Purge(before time.Time) (int, error) {
+	n, err := t.primary.Purge(before)
+	if err != nil {
+		return n, err
+	}
+	if _, serr := t.secondary.Purge(before); serr != nil {
+		log.Printf("mirror: secondary Purge: %v", serr)
+	}
+	return n, nil
+}
+
+func (t *MirrorTodoService) ArchiveCompleted() (int, error) {
+	n, err := t.primary.ArchiveCompleted()
+	if err != nil {
+		return n, err
+	}
+	if sn, serr := t.secondary.ArchiveCompleted(); serr != nil {
+		log.Printf("mirror: secondary ArchiveCompleted: %v", serr)
+	} else if sn != n {
+		log.Printf("mirror: ArchiveCompleted archived %d in primary, %d in secondary", n, sn)
+	}
+	return n, nil
+}
+
+func (t *MirrorTodoService) DeleteWhere(filter TodoFilter) (int, error) {
+	n, err := t.primary.DeleteWhere(filter)
+	if err != nil {
+		return n, err
+	}
+	if sn, serr := t.secondary.DeleteWhere(filter); serr != nil {
+		log.Printf("mirror: secondary DeleteWhere: %v", serr)
+	} else if sn != n {
+		log.Printf("mirror: DeleteWhere deleted %d from primary, %d from secondary", n, sn)
+	}
+	return n, nil
+}
+
+func (t *MirrorTodoService) Move(id, anchor int, after bool) (*Todo, bool, error) {
+	todo, moved, err := t.primary.Move(id, anchor, after)
+	if err != nil || !moved {
+		return todo, moved, err
+	}
+	sid, ok := t.secondaryId(id)
+	sanchor, aok := t.secondaryId(anchor)
+	if !ok || (anchor != 0 && !aok) {
+		log.Printf("mirror: Move: todo %d or %d has no secondary id, not mirrored", id, anchor)
+		return todo, moved, err
+	}
+	if _, _, err := t.secondary.Move(sid, sanchor, after); err != nil {
+		log.Printf("mirror: secondary Move(%d, %d): %v", sid, sanchor, err)
+	}
+	return todo, moved, nil
+}
+
+func (t *MirrorTodoService) Reorder(ids []int, complete bool) ([]*Todo, error) {
+	todos, err := t.primary.Reorder(ids, complete)
+	if err != nil {
+		return todos, err
+	}
+	sids := make([]int, len(ids))
+	for i, id := range ids {
+		sid, ok := t.secondaryId(id)
+		if !ok {
+			log.Printf("mirror: Reorder: todo %d has no secondary id, not mirrored", id)
+			return todos, nil
+		}
+		sids[i] = sid
+	}
+	if _, err := t.secondary.Reorder(sids, false); err != nil {
+		log.Printf("mirror: secondary Reorder: %v", err)
+	}
+	return todos, nil
+}
+
+func (t *MirrorTodoService) History(id, offset, limit int) ([]*Todo, int, error) {
+	return t.primary.History(id, offset, limit)
+}
+
+func (t *MirrorTodoService) Delete(id int) error {
+	if err := t.primary.Delete(id); err != nil {
+		return err
+	}
+	sid, ok := t.secondaryId(id)
+	if !ok {
+		log.Printf("mirror: Delete: todo %d has no secondary id, not mirrored", id)
+		return nil
+	}
+	if err := t.secondary.Delete(sid); err != nil {
+		log.Printf("mirror: secondary Delete(%d): %v", sid, err)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import "testing"
+
+// newDivergedMirror mirrors between two stores whose ids are one apart, as
+// when the secondary already held a todo before mirroring started.
+func newDivergedMirror(t *testing.T) (*MirrorTodoService, *MockTodoService) {
+	secondary := NewMockTodoService()
+	if err := secondary.Save(&Todo{Title: "already there"}); err != nil {
+		t.Fatal(err)
+	}
+	return NewMirrorTodoService(NewMockTodoService(), secondary, 0), secondary
+}
+
+func TestMirrorMapsSubtaskParents(t *testing.T) {
+	mirror, secondary := newDivergedMirror(t)
+	parent := &Todo{Title: "parent"}
+	if err := mirror.Save(parent); err != nil {
+		t.Fatal(err)
+	}
+	sparent, ok := mirror.secondaryId(parent.Id)
+	if !ok || sparent == parent.Id {
+		t.Fatalf("want the parent mirrored to another id, got %d, %v", sparent, ok)
+	}
+
+	ref := todoRef(parent.Id)
+	for name, write := range map[string]func(*Todo) error{
+		"Save":   mirror.Save,
+		"Create": func(todo *Todo) error { todo.Id = 100; return mirror.Create(todo) },
+		"Upsert": func(todo *Todo) error { todo.Id = 200; _, err := mirror.Upsert(todo); return err },
+	} {
+		subtask := &Todo{Title: name + " subtask", ParentId: &ref}
+		if err := write(subtask); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		sid, ok := mirror.secondaryId(subtask.Id)
+		if !ok {
+			t.Fatalf("%s: the subtask wasn't mirrored", name)
+		}
+		shadow, _ := secondary.Get(sid)
+		if shadow == nil || shadow.ParentId == nil || int(*shadow.ParentId) != sparent {
+			t.Fatalf("%s: the secondary subtask is %+v, want parent %d", name, shadow, sparent)
+		}
+	}
+}
+
+func TestMirrorSkipsSubtasksOfUnmappedParents(t *testing.T) {
+	mirror, secondary := newDivergedMirror(t)
+	parent := &Todo{Title: "from before mirroring"}
+	if err := mirror.primary.Save(parent); err != nil {
+		t.Fatal(err)
+	}
+
+	ref := todoRef(parent.Id)
+	subtask := &Todo{Title: "subtask", ParentId: &ref}
+	if err := mirror.Save(subtask); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if _, ok := mirror.secondaryId(subtask.Id); ok {
+		t.Fatal("a subtask of an unmapped parent was mirrored")
+	}
+	if subtasks, _ := secondary.Subtasks(parent.Id); len(subtasks) != 0 {
+		t.Fatalf("the secondary attached %d subtasks to an unrelated todo", len(subtasks))
+	}
+}
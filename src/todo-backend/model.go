@@ -1,11 +1,118 @@
 package main
 
-import ()
+import (
+	"encoding/json"
+	"maps"
+	"time"
+)
 
 type Todo struct {
 	Id        int    `json:"-"`
 	Title     string `json:"title"`
+	Notes     string `json:"notes,omitempty"`
 	Completed bool   `json:"completed"`
-	Order     int    `json:"order"`
-	Url       string `json:"url"`
+	// CompletedAt is set by the store when Completed becomes true
+	CompletedAt *time.Time `json:"completedAt,omitempty"`
+	Order       float64    `json:"order"`         // Fractional so items can be placed between others
+	Url         string     `json:"url,omitempty"` // Empty when urls are turned off
+	Tags        []string   `json:"tags,omitempty"`
+	DueDate     *time.Time `json:"dueDate,omitempty"`
+	Version     int        `json:"version"` // Incremented on every save
+	Seq         int64      `json:"seq"`     // From a counter all todos share, bumped on every write
+	UpdatedAt   time.Time  `json:"updatedAt"`
+	DeletedAt   *time.Time `json:"deletedAt,omitempty"` // Set when soft-deleted
+	// Archived todos are left out of the list but, unlike deleted ones, are
+	// still shown with ?archived=true. ArchivedAt is set by the store.
+	Archived   bool       `json:"archived"`
+	ArchivedAt *time.Time `json:"archivedAt,omitempty"`
+	// ParentId is the todo this is a subtask of, nil for a top-level todo.
+	// It is given when the subtask is created; later saves keep it.
+	ParentId *todoRef `json:"parentId,omitempty"`
+	// Meta is whatever JSON object a client attaches, stored and returned
+	// as given. A PATCH giving it replaces it whole.
+	Meta map[string]interface{} `json:"meta,omitempty"`
+}
+
+// clone copies a todo so the copy can be changed independently. The time and
+// parent pointers are shared since they are replaced, never modified, and so
+// are the values in Meta.
+func (t *Todo) clone() *Todo {
+	c := *t
+	c.Tags = append([]string(nil), t.Tags...)
+	c.Meta = maps.Clone(t.Meta)
+	return &c
+}
+
+// metaValue is the todo's meta value at key as a filter compares it: strings
+// as they are, other values as JSON, so ?meta.count=3 matches {"count": 3}.
+func metaValue(todo *Todo, key string) (string, bool) {
+	value, ok := todo.Meta[key]
+	if !ok {
+		return "", false
+	}
+	if s, isString := value.(string); isString {
+		return s, true
+	}
+	b, err := json.Marshal(value)
+	return string(b), err == nil
+}
+
+// orderBetween returns an Order that sorts between two neighbours without
+// renumbering either of them.
+func orderBetween(before, after float64) float64 {
+	return before + (after-before)/2
+}
+
+type TagCount struct {
+	Tag   string `json:"tag"`
+	Count int    `json:"count"`
+}
+
+// TagSummary counts the todos with a tag, or with none under untaggedKey.
+type TagSummary struct {
+	Tag       string `json:"tag"`
+	Total     int    `json:"total"`
+	Completed int    `json:"completed"`
+}
+
+// untaggedKey is the tag todos without tags are counted and grouped under,
+// in TagSummary and by GET /todos/grouped?by=tag.
+const untaggedKey = "(none)"
+
+type TodoStats struct {
+	Total           int     `json:"total"`
+	Completed       int     `json:"completed"`
+	Active          int     `json:"active"`
+	CompletionRatio float64 `json:"completion_ratio"`
+}
+
+// TodoFilter selects todos by field; zero fields match everything.
+type TodoFilter struct {
+	Completed *bool
+	Tag       string
+	Meta      map[string]string // Top-level meta keys to the value they must have, see metaValue
+}
+
+func (f TodoFilter) IsEmpty() bool {
+	return f.Completed == nil && f.Tag == "" && len(f.Meta) == 0
+}
+
+func (f TodoFilter) Matches(todo *Todo) bool {
+	if f.Completed != nil && todo.Completed != *f.Completed {
+		return false
+	}
+	for key, want := range f.Meta {
+		if value, ok := metaValue(todo, key); !ok || value != want {
+			return false
+		}
+	}
+	if f.Tag != "" {
+		for _, tag := range todo.Tags {
+			if tag == f.Tag {
+				return true
+			}
+		}
+		return false
+	}
+	return true
 }
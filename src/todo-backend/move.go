@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// moveHandler serves POST /todos/{id}/move, placing the todo relative to
+// another with {"after": <id>} or {"before": <id>}, or at an end of the list
+// with {"to": "start"} or {"to": "end"}. It returns the moved todo.
+func moveHandler(w http.ResponseWriter, r *http.Request, key string) {
+	if r.Method != "POST" {
+		writeError(w, r, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := decodeId(key)
+	if err != nil {
+		writeError(w, r, "Invalid Id", http.StatusBadRequest)
+		return
+	}
+	var body struct {
+		After  json.RawMessage `json:"after"`
+		Before json.RawMessage `json:"before"`
+		To     string          `json:"to"`
+	}
+	if !decodeBody(w, r, &body, moveTodoSchema) {
+		return
+	}
+
+	anchor, after := 0, false
+	given := 0
+	if len(body.After) > 0 {
+		given++
+		after = true
+		anchor, err = decodeJsonId(body.After)
+	}
+	if len(body.Before) > 0 {
+		given++
+		anchor, err = decodeJsonId(body.Before)
+	}
+	switch body.To {
+	case "":
+	case "start":
+		given++
+	case "end":
+		given++
+		after = true
+	default:
+		writeError(w, r, `"to" must be "start" or "end"`, 422)
+		return
+	}
+	if given != 1 {
+		writeError(w, r, `Give exactly one of "after", "before" or "to"`, 422)
+		return
+	}
+	if err != nil {
+		writeError(w, r, "Invalid Id", 422)
+		return
+	}
+
+	todo, _, err := storageFor(r).Move(id, anchor, after)
+	if err != nil {
+		writeStorageError(w, r, err)
+		return
+	}
+	if todo == nil {
+		writeError(w, r, "Not Found", http.StatusNotFound)
+		return
+	}
+	prepareTodos(r, todo)
+	writeJson(w, todo)
+}
+
+// reorderHandler serves PUT /todos/order, which takes the ids of the todos
+// in the order they should have, such as a board's whole column after a
+// drop, renumbers them in one go and returns the list as GET /todos would.
+// Todos left out follow the listed ones unless -reorder-complete makes that
+// a 422.
+func reorderHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "PUT" {
+		writeError(w, r, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var body []json.RawMessage
+	if !decodeBody(w, r, &body, orderTodosSchema) {
+		return
+	}
+	ids := make([]int, len(body))
+	for i, raw := range body {
+		id, err := decodeJsonId(raw)
+		if err != nil {
+			writeError(w, r, fmt.Sprintf("Invalid Id %s", raw), 422)
+			return
+		}
+		ids[i] = id
+	}
+
+	todos, err := storageFor(r).Reorder(ids, *reorderComplete)
+	if err != nil {
+		writeStorageError(w, r, err)
+		return
+	}
+	todos = topLevelOnly(archivedOnly(todos, false))
+	prepareTodos(r, todos...)
+	writeJsonMeta(w, todos, listMeta(len(todos)))
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// returnPreference is the return= value of the request's Prefer header
+// (RFC 7240), lower-cased, or "" when it has none.
+func returnPreference(r *http.Request) string {
+	for _, header := range r.Header.Values("Prefer") {
+		for _, preference := range strings.Split(header, ",") {
+			// Parameters after a ";" don't matter for return=.
+			preference, _, _ = strings.Cut(preference, ";")
+			name, value, _ := strings.Cut(preference, "=")
+			if strings.EqualFold(strings.TrimSpace(name), "return") {
+				return strings.ToLower(strings.Trim(strings.TrimSpace(value), `"`))
+			}
+		}
+	}
+	return ""
+}
+
+// writeTodo answers a successful write with the todo, or with no body when
+// the client sent Prefer: return=minimal: code 201 stays 201, with the
+// todo's url in Location, and 200 becomes 204. Either return= preference is
+// acknowledged in Preference-Applied.
+func writeTodo(w http.ResponseWriter, r *http.Request, code int, todo *Todo) {
+	w.Header().Add("Vary", "Prefer")
+	switch returnPreference(r) {
+	case "minimal":
+		w.Header().Set("Preference-Applied", "return=minimal")
+		w.Header().Add("Access-Control-Expose-Headers", "Preference-Applied")
+		if code == http.StatusCreated {
+			w.Header().Set("Location", todoUrl(r, todo.Id))
+		} else {
+			code = http.StatusNoContent
+		}
+		w.WriteHeader(code)
+		return
+	case "representation":
+		w.Header().Set("Preference-Applied", "return=representation")
+		w.Header().Add("Access-Control-Expose-Headers", "Preference-Applied")
+	}
+	prepareTodos(r, todo)
+	if code != http.StatusOK {
+		w.WriteHeader(code)
+	}
+	writeJsonMeta(w, todo, responseWarnings(w))
+}
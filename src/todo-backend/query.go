@@ -0,0 +1,268 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// todoOrderings compares todos by each field that ?sort= accepts, returning
+// a negative number when a sorts first.
+var todoOrderings = map[string]func(a, b *Todo) int{
+	"order": func(a, b *Todo) int { return compareFloats(a.Order, b.Order) },
+	"title": func(a, b *Todo) int { return strings.Compare(strings.ToLower(a.Title), strings.ToLower(b.Title)) },
+	"completed": func(a, b *Todo) int {
+		return compareFloats(boolRank(a.Completed), boolRank(b.Completed))
+	},
+	"dueDate":   func(a, b *Todo) int { return compareTimes(a.DueDate, b.DueDate) },
+	"updatedAt": func(a, b *Todo) int { return a.UpdatedAt.Compare(b.UpdatedAt) },
+	"id":        func(a, b *Todo) int { return cmp.Compare(a.Id, b.Id) },
+}
+
+// metaFilterPrefix starts the parameters filtering on a top-level meta key.
+const metaFilterPrefix = "meta."
+
+// todoFilters are the query parameters that filter the todos.
+// "meta" stands for every ?meta.<key>= parameter.
+var todoFilters = []string{"completed", "tag", "archived", "meta"}
+
+// sortableFields and filterableFields are the -sortable-fields and
+// -filterable-fields allowlists.
+var sortableFields, filterableFields map[string]bool
+
+// descendingByDefault has the fields -sort-directions sorts descending when
+// ?sort= gives no direction.
+var descendingByDefault map[string]bool
+
+// defaultSort is -default-sort, the order lists are given in when ?sort= is
+// left out. Empty leaves them in the order the store returns.
+var defaultSort []sortKey
+
+func compareFloats(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func boolRank(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// compareTimes orders missing times last.
+func compareTimes(a, b *time.Time) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return 1
+	case b == nil:
+		return -1
+	}
+	return a.Compare(*b)
+}
+
+// parseFieldList reads a comma-separated list of names that must all be in
+// known.
+func parseFieldList(list string, known func(string) bool) (map[string]bool, error) {
+	fields := make(map[string]bool)
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !known(name) {
+			return nil, fmt.Errorf("unknown field %q", name)
+		}
+		fields[name] = true
+	}
+	return fields, nil
+}
+
+// checkFilters returns an error naming the first filter parameter in the
+// request that -filterable-fields doesn't allow.
+func checkFilters(r *http.Request) error {
+	query := r.URL.Query()
+	for _, name := range todoFilters {
+		if query.Has(name) && !filterableFields[name] {
+			return fmt.Errorf("Filtering on %q is not allowed", name)
+		}
+	}
+	for name := range query {
+		if strings.HasPrefix(name, metaFilterPrefix) && !filterableFields["meta"] {
+			return fmt.Errorf("Filtering on %q is not allowed", "meta")
+		}
+	}
+	return nil
+}
+
+// parseSortDirections reads -sort-directions, a comma-separated list of
+// field:asc or field:desc, into the fields that sort descending.
+func parseSortDirections(list string) (map[string]bool, error) {
+	descending := make(map[string]bool)
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		field, dir, _ := strings.Cut(item, ":")
+		if todoOrderings[field] == nil {
+			return nil, fmt.Errorf("unknown field %q", field)
+		}
+		switch dir {
+		case "asc":
+			delete(descending, field)
+		case "desc":
+			descending[field] = true
+		default:
+			return nil, fmt.Errorf("invalid direction %q for %s: must be asc or desc", dir, field)
+		}
+	}
+	return descending, nil
+}
+
+// sortKey is one field of a sort.
+type sortKey struct {
+	compare    func(a, b *Todo) int
+	descending bool
+}
+
+// parseSort reads a sort, a comma-separated list of fields each optionally
+// prefixed with - for descending or + for ascending order, and otherwise
+// sorted in their -sort-directions direction. An unescaped + in a query
+// string arrives as a space, so a leading space counts as + too.
+func parseSort(list string) ([]sortKey, error) {
+	var keys []sortKey
+	for _, field := range strings.Split(list, ",") {
+		descending := descendingByDefault[strings.TrimSpace(field)]
+		switch {
+		case strings.HasPrefix(field, "-"):
+			descending = true
+		case strings.HasPrefix(field, "+"), strings.HasPrefix(field, " "):
+			descending = false
+		}
+		field = strings.TrimLeft(strings.TrimSpace(field), "+-")
+		compare, ok := todoOrderings[field]
+		if !ok {
+			return nil, fmt.Errorf("Cannot sort by %q", field)
+		}
+		if !sortableFields[field] {
+			return nil, fmt.Errorf("Sorting by %q is not allowed", field)
+		}
+		keys = append(keys, sortKey{compare, descending})
+	}
+	return keys, nil
+}
+
+// sortTodos orders todos by ?sort=, or by -default-sort without it. Ties
+// keep their order.
+func sortTodos(r *http.Request, todos []*Todo) error {
+	keys := defaultSort
+	if list := r.URL.Query().Get("sort"); list != "" {
+		var err error
+		if keys, err = parseSort(list); err != nil {
+			return err
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	sort.SliceStable(todos, func(i, j int) bool {
+		for _, k := range keys {
+			c := k.compare(todos[i], todos[j])
+			if k.descending {
+				c = -c
+			}
+			if c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+	return nil
+}
+
+// defaultPageSize is the page ?limit= gives when left out, or -max-page-size
+// if that is smaller.
+const defaultPageSize = 20
+
+// parsePage reads ?offset= and ?limit=, defaulting to the first page. The
+// page size is ?limit=, or else the client's X-Default-Page-Size header, or
+// else defaultPageSize, and is capped at -max-page-size.
+func parsePage(r *http.Request) (offset, limit int, err error) {
+	query := r.URL.Query()
+	limit = defaultPageSize
+	if value := r.Header.Get("X-Default-Page-Size"); value != "" {
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 {
+			return 0, 0, fmt.Errorf("Invalid X-Default-Page-Size %q", value)
+		}
+	}
+	if value := query.Get("limit"); value != "" {
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 {
+			return 0, 0, fmt.Errorf("Invalid limit %q", value)
+		}
+	}
+	if value := query.Get("offset"); value != "" {
+		if offset, err = strconv.Atoi(value); err != nil || offset < 0 {
+			return 0, 0, fmt.Errorf("Invalid offset %q", value)
+		}
+	}
+	return offset, min(limit, *maxPageSize), nil
+}
+
+// errUnsatisfiableRange is returned by itemsRange for a range of items it
+// can't serve.
+var errUnsatisfiableRange = errors.New("range not satisfiable")
+
+// itemsRange reads a Range: items=<first>-<last> header, or items=<first>-
+// for the rest, as the offset and limit of the page of the total items it
+// asks for, capped at -max-page-size like ?limit=. ok is false when there is no
+// range of items to honor. A range that is malformed, has several parts or
+// starts past the end gives errUnsatisfiableRange.
+func itemsRange(r *http.Request, total int) (offset, limit int, ok bool, err error) {
+	spec, found := strings.CutPrefix(r.Header.Get("Range"), "items=")
+	if !found {
+		return 0, 0, false, nil
+	}
+	first, last, dash := strings.Cut(strings.TrimSpace(spec), "-")
+	offset, err = strconv.Atoi(first)
+	if !dash || err != nil || offset < 0 || offset >= total {
+		return 0, 0, true, errUnsatisfiableRange
+	}
+	end := total - 1
+	if last != "" {
+		n, err := strconv.Atoi(last)
+		if err != nil || n < offset {
+			return 0, 0, true, errUnsatisfiableRange
+		}
+		end = min(n, end)
+	}
+	return offset, min(end-offset+1, *maxPageSize), true, nil
+}
+
+// setMaxPageSize tells the client how many items a page can have at most,
+// for responses that are a page.
+func setMaxPageSize(w http.ResponseWriter) {
+	w.Header().Set("X-Max-Page-Size", strconv.Itoa(*maxPageSize))
+	w.Header().Add("Access-Control-Expose-Headers", "X-Max-Page-Size")
+}
+
+// pageOf returns the limit items of todos starting at offset, or fewer at
+// the end.
+func pageOf(todos []*Todo, offset, limit int) []*Todo {
+	if offset >= len(todos) {
+		return todos[:0]
+	}
+	return todos[offset:min(offset+limit, len(todos))]
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+)
+
+// readOnly is set while writes are refused. It starts from -read-only and is
+// flipped by SIGHUP.
+var readOnly atomic.Bool
+
+// toggleReadOnlyOnSignal flips read-only mode each time the process receives
+// SIGHUP, so it can be switched during maintenance without a restart.
+func toggleReadOnlyOnSignal() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		on := !readOnly.Load()
+		readOnly.Store(on)
+		log.Printf("read-only mode: %v", on)
+	}
+}
+
+// rejectWrites answers anything but a read with a 503 while in read-only
+// mode. CORS preflights are let through, as are calls to /rpc, which refuses
+// the methods that write itself, and to /debug/echo, which writes nothing.
+func rejectWrites(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "GET", r.Method == "HEAD", r.Method == "OPTIONS", r.URL.Path == "/rpc", r.URL.Path == "/debug/echo":
+		default:
+			if readOnly.Load() {
+				writeStorageError(w, r, ErrReadOnly)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -2,86 +2,974 @@ package main
 
 import (
 	"fmt"
+	"slices"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 )
 
 // Define an interface for the data methods to support different storage types
 type TodoService interface {
-	GetAll() ([]Todo, error)
+	GetAll() ([]*Todo, error)
 	Get(id int) (*Todo, error)
+	// GetMany returns the todos with the given ids in the order asked for,
+	// leaving out any that don't exist.
+	GetMany(ids []int) ([]*Todo, error)
+	// GetByTag returns the live todos carrying tag, in GetAll's order.
+	GetByTag(tag string) ([]*Todo, error)
+	// GetChangedSince returns todos updated at or after t, including
+	// soft-deleted ones so clients can reconcile deletions.
+	GetChangedSince(t time.Time) ([]*Todo, error)
+	// GetChangedAfterSeq returns todos written after sequence number seq
+	// (see Todo.Seq), soft-deleted ones included, in the order written.
+	GetChangedAfterSeq(seq int64) ([]*Todo, error)
+	// Snapshot returns every todo as of a single point in time, without
+	// blocking writes while the caller uses it. Stores that can't provide
+	// that consistency return ErrNotSupported.
+	Snapshot() ([]*Todo, error)
+	Count() (int, error)
+	// CollectionVersion returns a number that grows with every change to
+	// the todos, so it can be compared instead of the todos themselves.
+	CollectionVersion() (uint64, error)
+	// ExistsByTitle reports whether a todo other than the one with id except
+	// has the title, ignoring case.
+	ExistsByTitle(title string, except int) (bool, error)
+	Stats() (TodoStats, error)
+	// Save inserts a todo with no Id or updates an existing one. A non-zero
+	// Version must match the stored one or ErrVersionConflict is returned.
+	// Under OrderReject an Order another todo has gives ErrDuplicateOrder.
 	Save(todo *Todo) error
+	// Create inserts a todo at its given Id, or a new one if it has none,
+	// returning ErrAlreadyExists if the id is taken.
+	Create(todo *Todo) error
+	// Upsert replaces the todo at its Id, or creates it there if there is
+	// none, reporting whether it was created.
+	Upsert(todo *Todo) (created bool, err error)
+	// ArchiveCompleted archives every completed todo that isn't already,
+	// returning how many.
+	ArchiveCompleted() (int, error)
+	// Move gives a todo an Order just after or before the anchor todo, or
+	// with an anchor of 0 makes it last or first. It returns the todo, nil
+	// if it doesn't exist, and whether it moved, which it doesn't if it is
+	// already there. ErrMissingAnchor means the anchor doesn't exist.
+	Move(id, anchor int, after bool) (todo *Todo, moved bool, err error)
+	// Reorder gives the todos with ids the orders 1, 2, ... in that
+	// sequence, all at once, and the other live todos the orders after
+	// them, keeping their relative order. It returns every live todo, in
+	// the new order. With complete, leaving out a todo GET /todos lists
+	// (one that is top-level and not archived) is ErrIncompleteOrder.
+	Reorder(ids []int, complete bool) ([]*Todo, error)
+	// TagCounts returns each tag in use with the number of todos carrying
+	// it, most used first.
+	TagCounts() ([]TagCount, error)
+	// TagSummaries counts the live todos carrying each tag and how many of
+	// them are completed, most used first, with untagged todos last under
+	// untaggedKey if there are any.
+	TagSummaries() ([]TagSummary, error)
+	// Subtasks returns the todos whose parent is the todo with id.
+	Subtasks(id int) ([]*Todo, error)
 	DeleteAll() error
+	// RenormalizeOrder renumbers Order to 1, 2, 3... keeping the current
+	// sequence if any two todos are closer than minGap. It reports whether it
+	// renumbered.
+	RenormalizeOrder(minGap float64) (bool, error)
+	// DeleteWhere deletes the todos matching filter, returning how many.
+	// It and Delete also delete the subtasks of the todos they delete, or
+	// without CascadeDeletes return ErrHasSubtasks and delete nothing.
+	DeleteWhere(filter TodoFilter) (int, error)
 	Delete(id int) error
+	// Purge permanently removes the todos deleted before a time, along
+	// with their history, returning how many. GetChangedSince stops
+	// reporting their deletion.
+	Purge(before time.Time) (int, error)
+	// History returns up to limit of the versions a todo has been saved
+	// as, newest first and skipping offset of them, with how many there are
+	// in all. Deletions are included. Stores may keep only recent versions.
+	History(id, offset, limit int) (versions []*Todo, total int, err error)
 }
 
-// MockTodoService uses a concurrent array for basic testing
+// storeOptions are the settings that apply to every store newTodoService
+// creates.
+type storeOptions struct {
+	MirrorSample float64   // See NewMirrorTodoService
+	OrderMode    OrderMode // See MockTodoService.OrderMode
+	HistoryLimit int       // See MockTodoService.HistoryLimit
+	// CascadeDeletes is MockTodoService.CascadeDeletes
+	CascadeDeletes bool
+	OnChange       func(*Todo) // See MockTodoService.OnChange
+	Clock          Clock       // See MockTodoService.Clock; nil keeps the default
+}
+
+// newTodoService creates the storage described by dsn: "memory" for the
+// in-memory mock, or "mirror:<primary>,<secondary>" to serve from primary while
+// shadowing writes to secondary (see MirrorTodoService).
+func newTodoService(dsn string, opts storeOptions) (TodoService, error) {
+	switch {
+	case dsn == "memory":
+		t := NewMockTodoService()
+		t.OrderMode = opts.OrderMode
+		t.HistoryLimit = opts.HistoryLimit
+		t.CascadeDeletes = opts.CascadeDeletes
+		t.OnChange = opts.OnChange
+		if opts.Clock != nil {
+			t.Clock = opts.Clock
+		}
+		return t, nil
+	case strings.HasPrefix(dsn, "mirror:"):
+		parts := strings.Split(strings.TrimPrefix(dsn, "mirror:"), ",")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid storage %q: want mirror:<primary>,<secondary>", dsn)
+		}
+		primary, err := newTodoService(parts[0], opts)
+		if err != nil {
+			return nil, err
+		}
+		opts.OnChange = nil // Changes are reported once, by the primary
+		secondary, err := newTodoService(parts[1], opts)
+		if err != nil {
+			return nil, err
+		}
+		return NewMirrorTodoService(primary, secondary, opts.MirrorSample), nil
+	}
+	return nil, fmt.Errorf("unknown storage %q", dsn)
+}
+
+// OrderMode says what a store does when a write gives a todo the same Order
+// as another one.
+type OrderMode string
+
+const (
+	// OrderAllow stores duplicate orders as they are.
+	OrderAllow OrderMode = "allow"
+	// OrderReject refuses the write with ErrDuplicateOrder.
+	OrderReject OrderMode = "reject"
+	// OrderShift moves the other todos at or after that order down by one
+	// to make room, bumping their versions.
+	OrderShift OrderMode = "shift"
+)
+
+// MockTodoService uses a concurrent array for basic testing. It stores and
+// returns copies so callers can't change stored todos behind its lock.
 type MockTodoService struct {
-	m      sync.Mutex
-	nextId int
-	Todos  []*Todo
+	m     sync.Mutex
+	ids   IDGenerator
+	Todos []*Todo
+	// version counts changes to the todos; see CollectionVersion.
+	version uint64
+	// OrderMode is how duplicate orders are handled; empty means OrderAllow.
+	OrderMode OrderMode
+	// HistoryLimit is how many versions of each todo History keeps; 0
+	// keeps none.
+	HistoryLimit int
+	// CascadeDeletes makes deleting a todo delete its subtasks, and theirs;
+	// otherwise deleting a todo with subtasks fails.
+	CascadeDeletes bool
+	// OnChange, if set, is called with every todo the store writes, as
+	// stored, while holding the lock.
+	OnChange func(*Todo)
+	// Clock stamps UpdatedAt, and so CompletedAt, ArchivedAt and DeletedAt.
+	Clock    Clock
+	versions map[int][]*Todo // Oldest first
+	// tagged indexes the live todos by tag and then id, so tag queries
+	// don't have to scan every todo's tags. Kept up to date by retag.
+	tagged map[string]map[int]*Todo
+	// appended is the Seq each todo was added to Todos with, so todos found
+	// through tagged can be put back in the order Todos has them.
+	appended map[int]int64
 }
 
 func NewMockTodoService() *MockTodoService {
+	return NewMockTodoServiceWithIDs(NewSequentialIDGenerator(1)) // Start at 1 so we can distinguish from unspecified (0)
+}
+
+func NewMockTodoServiceWithIDs(ids IDGenerator) *MockTodoService {
 	t := new(MockTodoService)
 	t.m.Lock()
 	t.Todos = make([]*Todo, 0)
-	t.nextId = 1 // Start at 1 so we can distinguish from unspecified (0)
+	t.ids = ids
+	t.Clock = systemClock{}
+	t.tagged = make(map[string]map[int]*Todo)
+	t.appended = make(map[int]int64)
+	t.versions = make(map[int][]*Todo)
 	t.m.Unlock()
 	return t
 }
 
+// now is the time to stamp a write with.
+func (t *MockTodoService) now() time.Time {
+	return t.Clock.Now().UTC()
+}
+
 func (t *MockTodoService) GetAll() ([]*Todo, error) {
-	return t.Todos, nil
+	t.m.Lock()
+	defer t.m.Unlock()
+	todos := make([]*Todo, 0, len(t.Todos))
+	for _, value := range t.Todos {
+		if value.DeletedAt == nil {
+			todos = append(todos, value.clone())
+		}
+	}
+	return todos, nil
 }
 
 func (t *MockTodoService) Get(id int) (*Todo, error) {
+	t.m.Lock()
+	defer t.m.Unlock()
 	for _, value := range t.Todos {
-		if value.Id == id {
-			return value, nil
+		if value.Id == id && value.DeletedAt == nil {
+			return value.clone(), nil
 		}
 	}
 	return nil, nil
 }
 
+func (t *MockTodoService) GetMany(ids []int) ([]*Todo, error) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	byId := make(map[int]*Todo, len(t.Todos))
+	for _, value := range t.Todos {
+		if value.DeletedAt == nil {
+			byId[value.Id] = value
+		}
+	}
+	todos := make([]*Todo, 0, len(ids))
+	for _, id := range ids {
+		if todo, ok := byId[id]; ok {
+			todos = append(todos, todo.clone())
+		}
+	}
+	return todos, nil
+}
+
+func (t *MockTodoService) GetByTag(tag string) ([]*Todo, error) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	todos := make([]*Todo, 0, len(t.tagged[tag]))
+	for _, value := range t.tagged[tag] {
+		todos = append(todos, value.clone())
+	}
+	sort.Slice(todos, func(i, j int) bool {
+		return t.appended[todos[i].Id] < t.appended[todos[j].Id]
+	})
+	return todos, nil
+}
+
+func (t *MockTodoService) GetChangedSince(since time.Time) ([]*Todo, error) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	todos := make([]*Todo, 0)
+	for _, value := range t.Todos {
+		if !value.UpdatedAt.Before(since) {
+			todos = append(todos, value.clone())
+		}
+	}
+	return todos, nil
+}
+
+func (t *MockTodoService) GetChangedAfterSeq(seq int64) ([]*Todo, error) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	todos := make([]*Todo, 0)
+	for _, value := range t.Todos {
+		if value.Seq > seq {
+			todos = append(todos, value.clone())
+		}
+	}
+	sort.Slice(todos, func(i, j int) bool { return todos[i].Seq < todos[j].Seq })
+	return todos, nil
+}
+
+// Snapshot copies the todos under the lock, so writes are only held up for
+// the copy and not while the result is sent.
+func (t *MockTodoService) Snapshot() ([]*Todo, error) {
+	return t.GetAll()
+}
+
+func (t *MockTodoService) CollectionVersion() (uint64, error) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	return t.version, nil
+}
+
+func (t *MockTodoService) Count() (int, error) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	n := 0
+	for _, value := range t.Todos {
+		if value.DeletedAt == nil {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (t *MockTodoService) ExistsByTitle(title string, except int) (bool, error) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	for _, value := range t.Todos {
+		if value.DeletedAt == nil && value.Id != except && strings.EqualFold(value.Title, title) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (t *MockTodoService) Stats() (TodoStats, error) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	var stats TodoStats
+	for _, value := range t.Todos {
+		if value.DeletedAt != nil {
+			continue
+		}
+		stats.Total++
+		if value.Completed {
+			stats.Completed++
+		}
+	}
+	stats.Active = stats.Total - stats.Completed
+	if stats.Total > 0 {
+		stats.CompletionRatio = float64(stats.Completed) / float64(stats.Total)
+	}
+	return stats, nil
+}
+
 func (t *MockTodoService) Save(todo *Todo) error {
-	if todo.Id == 0 { // Insert
-		t.m.Lock()
-		todo.Id = t.nextId
-		t.nextId++
-		t.m.Unlock()
+	todo.UpdatedAt = t.now()
+	todo.DeletedAt = nil
 
+	// Insert. The id is picked and the todo added under one hold of the
+	// lock, so a concurrent Create can't take the id in between.
+	if todo.Id == 0 {
 		t.m.Lock()
-		t.Todos = append(t.Todos, todo)
-		t.m.Unlock()
+		defer t.m.Unlock()
+		for todo.Id == 0 {
+			id, err := t.ids.Next()
+			if err != nil {
+				return err
+			}
+			if !t.used(id) { // Skip ids clients chose with Create
+				todo.Id = id
+			}
+		}
+		todo.Version = 1
+		stampCompletion(todo, nil)
+		stampArchive(todo, nil)
+
+		stored := todo.clone()
+		if err := t.checkParent(stored); err != nil {
+			return err
+		}
+		if err := t.placeOrder(stored); err != nil {
+			return err
+		}
+		t.Todos = append(t.Todos, stored)
+		t.changed(stored)
+		t.appended[stored.Id] = stored.Seq
+		t.retag(nil, stored)
+		todo.Seq = stored.Seq
 		return nil
 	}
 
-	// Update existing
+	// Update existing, checking the version when the caller gave one. The
+	// lock is held from the lookup to the write so a concurrent Delete
+	// either happens first, making this a not found, or after.
+	t.m.Lock()
+	defer t.m.Unlock()
+	for i, value := range t.Todos {
+		if value.Id == todo.Id && value.DeletedAt == nil {
+			if todo.Version != 0 && todo.Version != value.Version {
+				return ErrVersionConflict
+			}
+			todo.Version = value.Version + 1
+			todo.ParentId = value.ParentId
+			stampCompletion(todo, value)
+			stampArchive(todo, value)
+			stored := todo.clone()
+			if err := t.placeOrder(stored); err != nil {
+				return err
+			}
+			t.retag(value, stored)
+			t.Todos[i] = stored
+			t.changed(stored)
+			todo.Seq = stored.Seq
+			return nil
+		}
+	}
+
+	return ErrNotFound
+}
+
+// changed notes a write to a stored todo, counting it in the collection
+// version, which also gives the todo its Seq, reporting it to OnChange and
+// adding a copy to the todo's history. The caller must hold t.m.
+func (t *MockTodoService) changed(todo *Todo) {
+	t.version++
+	todo.Seq = int64(t.version)
+	if t.OnChange != nil {
+		t.OnChange(todo)
+	}
+	if t.HistoryLimit <= 0 {
+		return
+	}
+	versions := append(t.versions[todo.Id], todo.clone())
+	if len(versions) > t.HistoryLimit {
+		versions = versions[len(versions)-t.HistoryLimit:]
+	}
+	t.versions[todo.Id] = versions
+}
+
+func (t *MockTodoService) History(id, offset, limit int) ([]*Todo, int, error) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	versions := t.versions[id]
+	page := make([]*Todo, 0, limit)
+	for i := len(versions) - 1 - offset; i >= 0 && len(page) < limit; i-- {
+		page = append(page, versions[i].clone())
+	}
+	return page, len(versions), nil
+}
+
+// used reports whether any todo, even a deleted one, has id. The caller must
+// hold t.m.
+func (t *MockTodoService) used(id int) bool {
+	for _, value := range t.Todos {
+		if value.Id == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *MockTodoService) Create(todo *Todo) error {
+	if todo.Id == 0 {
+		return t.Save(todo)
+	}
+
+	t.m.Lock()
+	defer t.m.Unlock()
+	for _, value := range t.Todos {
+		if value.Id == todo.Id && value.DeletedAt == nil {
+			return ErrAlreadyExists
+		}
+	}
+	return t.insertAt(todo)
+}
+
+func (t *MockTodoService) Upsert(todo *Todo) (bool, error) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	for i, value := range t.Todos {
+		if value.Id == todo.Id && value.DeletedAt == nil {
+			if todo.Version != 0 && todo.Version != value.Version {
+				return false, ErrVersionConflict
+			}
+			todo.UpdatedAt = t.now()
+			todo.DeletedAt = nil
+			todo.Version = value.Version + 1
+			todo.ParentId = value.ParentId
+			stampCompletion(todo, value)
+			stampArchive(todo, value)
+			stored := todo.clone()
+			if err := t.placeOrder(stored); err != nil {
+				return false, err
+			}
+			t.retag(value, stored)
+			t.Todos[i] = stored
+			t.changed(stored)
+			todo.Seq = stored.Seq
+			return false, nil
+		}
+	}
+	if err := t.insertAt(todo); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// insertAt adds a todo at its own id, replacing a deleted todo with that id
+// if there is one. The new todo's version carries on from the deleted one's
+// so versions and ETags read before the delete stay stale. The caller must
+// hold t.m.
+func (t *MockTodoService) insertAt(todo *Todo) error {
+	if err := t.checkParent(todo); err != nil {
+		return err
+	}
+	if err := t.placeOrder(todo); err != nil {
+		return err
+	}
+	version := 1
 	for i, value := range t.Todos {
 		if value.Id == todo.Id {
-			t.Todos[i] = todo
+			version = value.Version + 1
+			t.Todos = append(t.Todos[:i], t.Todos[i+1:]...)
+			break
+		}
+	}
+	todo.UpdatedAt = t.now()
+	todo.DeletedAt = nil
+	todo.Version = version
+	stampCompletion(todo, nil)
+	stampArchive(todo, nil)
+	stored := todo.clone()
+	t.Todos = append(t.Todos, stored)
+	t.changed(stored)
+	t.appended[stored.Id] = stored.Seq
+	t.retag(nil, stored)
+	todo.Seq = stored.Seq
+	return nil
+}
+
+// checkParent returns ErrMissingParent if a todo about to be inserted is a
+// subtask of one that isn't live. The caller must hold t.m.
+func (t *MockTodoService) checkParent(todo *Todo) error {
+	if todo.ParentId == nil {
+		return nil
+	}
+	for _, value := range t.Todos {
+		if value.Id == int(*todo.ParentId) && value.Id != todo.Id && value.DeletedAt == nil {
 			return nil
 		}
 	}
+	return ErrMissingParent
+}
+
+// placeOrder applies t.OrderMode to a todo about to be stored, checking its
+// Order against the other live todos. The caller must hold t.m.
+func (t *MockTodoService) placeOrder(todo *Todo) error {
+	if t.OrderMode != OrderReject && t.OrderMode != OrderShift {
+		return nil
+	}
+	taken := false
+	for _, value := range t.Todos {
+		if value.Id != todo.Id && value.DeletedAt == nil && value.Order == todo.Order {
+			taken = true
+			break
+		}
+	}
+	if !taken {
+		return nil
+	}
+	if t.OrderMode == OrderReject {
+		return ErrDuplicateOrder
+	}
+
+	// Shifting everything from the order on keeps those todos in sequence
+	// and clear of the ones before, whatever their gaps.
+	now := t.now()
+	for _, value := range t.Todos {
+		if value.Id != todo.Id && value.DeletedAt == nil && value.Order >= todo.Order {
+			value.Order++
+			value.UpdatedAt = now
+			value.Version++
+			t.changed(value)
+		}
+	}
+	return nil
+}
+
+// retag moves a todo's entries in the tag index from the stored todo it
+// replaces to its replacement. Either may be nil, for an insert or a delete.
+// The caller must hold t.m.
+func (t *MockTodoService) retag(previous, todo *Todo) {
+	if previous != nil {
+		for _, tag := range previous.Tags {
+			delete(t.tagged[tag], previous.Id)
+			if len(t.tagged[tag]) == 0 {
+				delete(t.tagged, tag)
+			}
+		}
+	}
+	if todo != nil {
+		for _, tag := range todo.Tags {
+			if t.tagged[tag] == nil {
+				t.tagged[tag] = make(map[int]*Todo)
+			}
+			t.tagged[tag][todo.Id] = todo
+		}
+	}
+}
+
+// stampCompletion sets CompletedAt when a todo becomes completed, keeps it
+// while it stays completed and clears it when it is reopened. previous is
+// the stored todo being replaced, or nil for an insert.
+func stampCompletion(todo, previous *Todo) {
+	switch {
+	case !todo.Completed:
+		todo.CompletedAt = nil
+	case previous != nil && previous.Completed:
+		todo.CompletedAt = previous.CompletedAt
+	default:
+		now := todo.UpdatedAt
+		todo.CompletedAt = &now
+	}
+}
+
+// stampArchive is stampCompletion for Archived and ArchivedAt.
+func stampArchive(todo, previous *Todo) {
+	switch {
+	case !todo.Archived:
+		todo.ArchivedAt = nil
+	case previous != nil && previous.Archived:
+		todo.ArchivedAt = previous.ArchivedAt
+	default:
+		now := todo.UpdatedAt
+		todo.ArchivedAt = &now
+	}
+}
+
+func (t *MockTodoService) ArchiveCompleted() (int, error) {
+	now := t.now()
+	n := 0
+	t.m.Lock()
+	defer t.m.Unlock()
+	for _, value := range t.Todos {
+		if value.DeletedAt == nil && value.Completed && !value.Archived {
+			value.Archived = true
+			value.ArchivedAt = &now
+			value.UpdatedAt = now
+			value.Version++
+			t.changed(value)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (t *MockTodoService) RenormalizeOrder(minGap float64) (bool, error) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	todos := make([]*Todo, 0, len(t.Todos))
+	for _, value := range t.Todos {
+		if value.DeletedAt == nil {
+			todos = append(todos, value)
+		}
+	}
+	sort.SliceStable(todos, func(i, j int) bool { return todos[i].Order < todos[j].Order })
 
-	return fmt.Errorf("Not Found")
+	crowded := false
+	for i := 1; i < len(todos); i++ {
+		if todos[i].Order-todos[i-1].Order < minGap {
+			crowded = true
+			break
+		}
+	}
+	if !crowded {
+		return false, nil
+	}
+
+	now := t.now()
+	for i, value := range todos {
+		if value.Order != float64(i+1) {
+			value.Order = float64(i + 1)
+			value.UpdatedAt = now
+			value.Version++
+			t.changed(value)
+		}
+	}
+	return true, nil
 }
 
+func (t *MockTodoService) Reorder(ids []int, complete bool) ([]*Todo, error) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	live := make(map[int]*Todo, len(t.Todos))
+	for _, value := range t.Todos {
+		if value.DeletedAt == nil {
+			live[value.Id] = value
+		}
+	}
+	todos := make([]*Todo, 0, len(live))
+	listed := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		if live[id] == nil || listed[id] {
+			return nil, ErrInvalidOrder
+		}
+		listed[id] = true
+		todos = append(todos, live[id])
+	}
+	rest := make([]*Todo, 0, len(live)-len(todos))
+	for _, value := range t.Todos {
+		if value.DeletedAt != nil || listed[value.Id] {
+			continue
+		}
+		if complete && value.ParentId == nil && !value.Archived {
+			return nil, ErrIncompleteOrder
+		}
+		rest = append(rest, value)
+	}
+	sort.SliceStable(rest, func(i, j int) bool { return rest[i].Order < rest[j].Order })
+	todos = append(todos, rest...)
+
+	now := t.now()
+	reordered := make([]*Todo, len(todos))
+	for i, value := range todos {
+		if value.Order != float64(i+1) {
+			value.Order = float64(i + 1)
+			value.UpdatedAt = now
+			value.Version++
+			t.changed(value)
+		}
+		reordered[i] = value.clone()
+	}
+	return reordered, nil
+}
+
+func (t *MockTodoService) Move(id, anchor int, after bool) (*Todo, bool, error) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	todos := make([]*Todo, 0, len(t.Todos))
+	var todo *Todo
+	for _, value := range t.Todos {
+		if value.DeletedAt != nil {
+			continue
+		}
+		if value.Id == id {
+			todo = value
+		} else {
+			todos = append(todos, value)
+		}
+	}
+	if todo == nil {
+		return nil, false, nil
+	}
+	if anchor == id {
+		return todo.clone(), false, nil
+	}
+	sort.SliceStable(todos, func(i, j int) bool { return todos[i].Order < todos[j].Order })
+
+	// Work out the neighbours the todo should end up between, where nil
+	// means the end of the list.
+	k := -1
+	if anchor == 0 {
+		if after {
+			k = len(todos) - 1
+		}
+	} else {
+		for i, value := range todos {
+			if value.Id == anchor {
+				k = i
+				break
+			}
+		}
+		if k < 0 {
+			return nil, false, ErrMissingAnchor
+		}
+		if !after {
+			k--
+		}
+	}
+	var prev, next *Todo
+	if k >= 0 {
+		prev = todos[k]
+	}
+	if k+1 < len(todos) {
+		next = todos[k+1]
+	}
+
+	if (prev == nil || prev.Order < todo.Order) && (next == nil || todo.Order < next.Order) {
+		return todo.clone(), false, nil // Already there
+	}
+	moved := todo.clone()
+	switch {
+	case prev != nil && next != nil:
+		moved.Order = orderBetween(prev.Order, next.Order)
+	case prev != nil:
+		moved.Order = prev.Order + 1
+	case next != nil:
+		moved.Order = next.Order - 1
+	}
+	if err := t.placeOrder(moved); err != nil {
+		return nil, false, err
+	}
+	todo.Order = moved.Order
+	todo.UpdatedAt = t.now()
+	todo.Version++
+	t.changed(todo)
+	return todo.clone(), true, nil
+}
+
+func (t *MockTodoService) TagCounts() ([]TagCount, error) {
+	t.m.Lock()
+	tags := make([]TagCount, 0, len(t.tagged))
+	for tag, todos := range t.tagged {
+		tags = append(tags, TagCount{Tag: tag, Count: len(todos)})
+	}
+	t.m.Unlock()
+
+	sort.Slice(tags, func(i, j int) bool {
+		if tags[i].Count != tags[j].Count {
+			return tags[i].Count > tags[j].Count
+		}
+		return tags[i].Tag < tags[j].Tag
+	})
+	return tags, nil
+}
+
+func (t *MockTodoService) TagSummaries() ([]TagSummary, error) {
+	t.m.Lock()
+	byTag := make(map[string]*TagSummary)
+	untagged := TagSummary{Tag: untaggedKey}
+	for _, value := range t.Todos {
+		if value.DeletedAt != nil {
+			continue
+		}
+		counts := []*TagSummary{&untagged}
+		if len(value.Tags) > 0 {
+			counts = counts[:0]
+			for _, tag := range value.Tags {
+				if byTag[tag] == nil {
+					byTag[tag] = &TagSummary{Tag: tag}
+				}
+				if !slices.Contains(counts, byTag[tag]) { // Once per todo
+					counts = append(counts, byTag[tag])
+				}
+			}
+		}
+		for _, count := range counts {
+			count.Total++
+			if value.Completed {
+				count.Completed++
+			}
+		}
+	}
+	t.m.Unlock()
+
+	summaries := make([]TagSummary, 0, len(byTag)+1)
+	for _, summary := range byTag {
+		summaries = append(summaries, *summary)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		if summaries[i].Total != summaries[j].Total {
+			return summaries[i].Total > summaries[j].Total
+		}
+		return summaries[i].Tag < summaries[j].Tag
+	})
+	if untagged.Total > 0 {
+		summaries = append(summaries, untagged)
+	}
+	return summaries, nil
+}
+
+func (t *MockTodoService) Subtasks(id int) ([]*Todo, error) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	todos := make([]*Todo, 0)
+	for _, value := range t.Todos {
+		if value.DeletedAt == nil && value.ParentId != nil && int(*value.ParentId) == id {
+			todos = append(todos, value.clone())
+		}
+	}
+	return todos, nil
+}
+
+// withSubtasks adds the live subtasks of the todos in deleting to it, and
+// theirs in turn, or returns ErrHasSubtasks if there are any and
+// t.CascadeDeletes is off. The caller must hold t.m.
+func (t *MockTodoService) withSubtasks(deleting map[int]*Todo) error {
+	for added := true; added; {
+		added = false
+		for _, value := range t.Todos {
+			if value.DeletedAt != nil || value.ParentId == nil || deleting[value.Id] != nil || deleting[int(*value.ParentId)] == nil {
+				continue
+			}
+			if !t.CascadeDeletes {
+				return ErrHasSubtasks
+			}
+			deleting[value.Id] = value
+			added = true
+		}
+	}
+	return nil
+}
+
+// DeleteAll and Delete mark todos as deleted rather than removing them so
+// that GetChangedSince can report the deletion.
 func (t *MockTodoService) DeleteAll() error {
+	now := t.now()
 	t.m.Lock()
-	t.Todos = make([]*Todo, 0)
+	for _, value := range t.Todos {
+		if value.DeletedAt == nil {
+			value.UpdatedAt = now
+			value.DeletedAt = &now
+			t.changed(value)
+		}
+	}
+	t.tagged = make(map[string]map[int]*Todo)
 	t.m.Unlock()
 	return nil
 }
 
+func (t *MockTodoService) DeleteWhere(filter TodoFilter) (int, error) {
+	now := t.now()
+	n := 0
+	t.m.Lock()
+	defer t.m.Unlock()
+	candidates := t.Todos
+	if filter.Tag != "" {
+		// Only the todos carrying the tag can match.
+		candidates = make([]*Todo, 0, len(t.tagged[filter.Tag]))
+		for _, value := range t.tagged[filter.Tag] {
+			candidates = append(candidates, value)
+		}
+	}
+	deleting := make(map[int]*Todo)
+	for _, value := range candidates {
+		if value.DeletedAt == nil && filter.Matches(value) {
+			deleting[value.Id] = value
+		}
+	}
+	if err := t.withSubtasks(deleting); err != nil {
+		return 0, err
+	}
+	for _, value := range deleting {
+		t.retag(value, nil)
+		value.UpdatedAt = now
+		value.DeletedAt = &now
+		t.changed(value)
+		n++
+	}
+	return n, nil
+}
+
 func (t *MockTodoService) Delete(id int) error {
-	for i, value := range t.Todos {
-		if value.Id == id {
-			t.m.Lock()
-			t.Todos = append(t.Todos[:i], t.Todos[i+1:]...)
-			t.m.Unlock()
+	t.m.Lock()
+	defer t.m.Unlock()
+	for _, value := range t.Todos {
+		if value.Id == id && value.DeletedAt == nil {
+			deleting := map[int]*Todo{id: value}
+			if err := t.withSubtasks(deleting); err != nil {
+				return err
+			}
+			now := t.now()
+			for _, value := range deleting {
+				t.retag(value, nil)
+				value.UpdatedAt = now
+				value.DeletedAt = &now
+				t.changed(value)
+			}
 			return nil
 		}
 	}
 	return nil
 }
+
+// Purge filters the deleted todos out under the lock.
+func (t *MockTodoService) Purge(before time.Time) (int, error) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	kept := t.Todos[:0]
+	for _, value := range t.Todos {
+		if value.DeletedAt != nil && value.DeletedAt.Before(before) {
+			delete(t.versions, value.Id)
+			delete(t.appended, value.Id)
+			continue
+		}
+		kept = append(kept, value)
+	}
+	n := len(t.Todos) - len(kept)
+	clear(t.Todos[len(kept):]) // Let the purged todos be collected
+	t.Todos = kept
+	return n, nil
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSaveStopsAtIdLimit(t *testing.T) {
+	store := NewMockTodoServiceWithIDs(NewSequentialIDGenerator(math.MaxInt - 1))
+	last := &Todo{Title: "last"}
+	if err := store.Save(last); err != nil {
+		t.Fatalf("Save with one id left: %v", err)
+	}
+	if last.Id != math.MaxInt-1 {
+		t.Fatalf("got id %d, want %d", last.Id, math.MaxInt-1)
+	}
+
+	err := store.Save(&Todo{Title: "one too many"})
+	if !errors.Is(err, ErrIdsExhausted) {
+		t.Fatalf("Save past the limit: got %v, want ErrIdsExhausted", err)
+	}
+	todos, err := store.GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(todos) != 1 || todos[0].Id != last.Id {
+		t.Fatalf("got %d todos, want only the last one saved", len(todos))
+	}
+}
+
+func TestCreateWithFreeId(t *testing.T) {
+	store := NewMockTodoService()
+	todo := &Todo{Id: 42, Title: "chosen"}
+	if err := store.Create(todo); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if todo.Id != 42 {
+		t.Fatalf("got id %d, want 42", todo.Id)
+	}
+	stored, err := store.Get(42)
+	if err != nil || stored == nil || stored.Title != "chosen" {
+		t.Fatalf("Get(42) = %+v, %v", stored, err)
+	}
+}
+
+func TestCreateWithTakenId(t *testing.T) {
+	store := NewMockTodoService()
+	first := &Todo{Title: "first"}
+	if err := store.Save(first); err != nil {
+		t.Fatal(err)
+	}
+	err := store.Create(&Todo{Id: first.Id, Title: "second"})
+	if !errors.Is(err, ErrConflict) {
+		t.Fatalf("Create on a taken id: got %v, want ErrConflict", err)
+	}
+	stored, _ := store.Get(first.Id)
+	if stored == nil || stored.Title != "first" {
+		t.Fatalf("the stored todo was changed to %+v", stored)
+	}
+}
+
+func TestSaveUnknownIdIsNotFound(t *testing.T) {
+	stores := map[string]func() TodoService{
+		"memory": func() TodoService { return NewMockTodoService() },
+		"mirror": func() TodoService {
+			return NewMirrorTodoService(NewMockTodoService(), NewMockTodoService(), 1)
+		},
+		"breaker": func() TodoService {
+			return NewCircuitBreakerTodoService(NewMockTodoService(), 5, time.Second)
+		},
+		"undoable": func() TodoService {
+			return &undoableTodoService{TodoService: &notifyingTodoService{NewMockTodoService(), newChangeFeed()}, limit: 10}
+		},
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			err := newStore().Save(&Todo{Id: 99, Title: "nobody"})
+			if !errors.Is(err, ErrNotFound) {
+				t.Fatalf("Save of an unknown id: got %v, want ErrNotFound", err)
+			}
+		})
+	}
+}
+
+func TestCompletedAt(t *testing.T) {
+	start := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	fake := NewFakeClock(start)
+	store := NewMockTodoService()
+	store.Clock = fake
+
+	todo := &Todo{Title: "report"}
+	if err := store.Save(todo); err != nil {
+		t.Fatal(err)
+	}
+	if todo.CompletedAt != nil {
+		t.Fatalf("an open todo has CompletedAt %v", todo.CompletedAt)
+	}
+	save := func(completed bool) *Todo {
+		t.Helper()
+		fake.Advance(time.Hour)
+		if err := store.Save(&Todo{Id: todo.Id, Title: todo.Title, Completed: completed}); err != nil {
+			t.Fatal(err)
+		}
+		stored, err := store.Get(todo.Id)
+		if err != nil || stored == nil {
+			t.Fatalf("Get: %v, %v", stored, err)
+		}
+		return stored
+	}
+
+	completedAt := start.Add(time.Hour)
+	if stored := save(true); stored.CompletedAt == nil || !stored.CompletedAt.Equal(completedAt) {
+		t.Fatalf("false to true: CompletedAt %v, want %v", stored.CompletedAt, completedAt)
+	}
+	if stored := save(true); stored.CompletedAt == nil || !stored.CompletedAt.Equal(completedAt) {
+		t.Fatalf("true to true: CompletedAt %v, want it kept at %v", stored.CompletedAt, completedAt)
+	}
+	if stored := save(false); stored.CompletedAt != nil {
+		t.Fatalf("true to false: CompletedAt %v, want it cleared", stored.CompletedAt)
+	}
+}
+
+// scanTagCounts counts tags the way TagCounts did before the tag index, by
+// going through every todo's tags.
+func scanTagCounts(t *MockTodoService) []TagCount {
+	t.m.Lock()
+	counts := make(map[string]int)
+	for _, todo := range t.Todos {
+		if todo.DeletedAt != nil {
+			continue
+		}
+		for _, tag := range todo.Tags {
+			counts[tag]++
+		}
+	}
+	t.m.Unlock()
+
+	tags := make([]TagCount, 0, len(counts))
+	for tag, n := range counts {
+		tags = append(tags, TagCount{Tag: tag, Count: n})
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		if tags[i].Count != tags[j].Count {
+			return tags[i].Count > tags[j].Count
+		}
+		return tags[i].Tag < tags[j].Tag
+	})
+	return tags
+}
+
+func BenchmarkTagCounts(b *testing.B) {
+	store := NewMockTodoService()
+	for i := 0; i < 10000; i++ {
+		tags := []string{fmt.Sprintf("project-%d", i%50), fmt.Sprintf("week-%d", i%52), "all"}
+		if err := store.Save(&Todo{Title: fmt.Sprintf("todo %d", i), Tags: tags}); err != nil {
+			b.Fatal(err)
+		}
+	}
+	indexed, _ := store.TagCounts()
+	if !reflect.DeepEqual(indexed, scanTagCounts(store)) {
+		b.Fatal("the index and a scan count tags differently")
+	}
+
+	b.Run("index", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			store.TagCounts()
+		}
+	})
+	b.Run("scan", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			scanTagCounts(store)
+		}
+	})
+}
+
+// TestGetByTagOrder checks GetByTag lists todos as GetAll does, even when
+// their ids aren't in that order.
+func TestGetByTagOrder(t *testing.T) {
+	store := NewMockTodoService()
+	for _, id := range []int{30, 10, 20} {
+		if err := store.Create(&Todo{Id: id, Title: "tagged", Tags: []string{"work"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Create(&Todo{Id: 5, Title: "untagged"}); err != nil {
+		t.Fatal(err)
+	}
+	// Putting back a deleted todo moves it to the end.
+	if err := store.Delete(10); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Upsert(&Todo{Id: 10, Title: "back", Tags: []string{"work"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	all, _ := store.GetAll()
+	tagged, _ := store.GetByTag("work")
+	if want := filtered(all, TodoFilter{Tag: "work"}); !reflect.DeepEqual(tagged, want) {
+		t.Fatalf("GetByTag returned %v, want %v", idsOf(tagged), idsOf(want))
+	}
+	if none, _ := store.GetByTag("home"); len(none) != 0 {
+		t.Fatalf("GetByTag of an unused tag returned %v", idsOf(none))
+	}
+}
+
+func idsOf(todos []*Todo) []int {
+	list := make([]int, len(todos))
+	for i, todo := range todos {
+		list[i] = todo.Id
+	}
+	return list
+}
+
+func BenchmarkGetByTag(b *testing.B) {
+	store := NewMockTodoService()
+	for i := 0; i < 10000; i++ {
+		tags := []string{fmt.Sprintf("project-%d", i%50)}
+		if err := store.Save(&Todo{Title: fmt.Sprintf("todo %d", i), Tags: tags}); err != nil {
+			b.Fatal(err)
+		}
+	}
+	filter := TodoFilter{Tag: "project-7"}
+
+	b.Run("index", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			store.GetByTag(filter.Tag)
+		}
+	})
+	b.Run("scan", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			all, _ := store.GetAll()
+			filtered(all, filter)
+		}
+	})
+}
+
+// TestConcurrentInserts runs inserts at once, some with ids of their own.
+// Run it with -race. The store's ids must come out unique, and those it
+// picked contiguous.
+func TestConcurrentInserts(t *testing.T) {
+	const inserts, chosen = 500, 100
+	store := NewMockTodoService()
+	var wg sync.WaitGroup
+	errs := make(chan error, inserts+chosen)
+	for i := 0; i < inserts; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- store.Save(&Todo{Title: fmt.Sprintf("insert %d", i)})
+		}(i)
+	}
+	for i := 0; i < chosen; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- store.Create(&Todo{Id: 1000000 + i, Title: fmt.Sprintf("chosen %d", i)})
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	todos, err := store.GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(todos) != inserts+chosen {
+		t.Fatalf("got %d todos, want %d", len(todos), inserts+chosen)
+	}
+	seen := make(map[int]bool, len(todos))
+	var picked []int
+	for _, todo := range todos {
+		if seen[todo.Id] {
+			t.Fatalf("id %d was given out twice", todo.Id)
+		}
+		seen[todo.Id] = true
+		if todo.Id < 1000000 {
+			picked = append(picked, todo.Id)
+		}
+	}
+	sort.Ints(picked)
+	for i, id := range picked {
+		if id != i+1 {
+			t.Fatalf("the store's ids aren't 1 to %d: %d is at position %d", inserts, id, i+1)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Each request gets an id, taken from the -request-id-header a proxy sent or
+// else made up, which is echoed in the response and logged with the access
+// log line and any storage error the request ran into, so the two can be
+// matched up.
+
+type requestIdKey struct{}
+
+// requestIds gives each request its id.
+func requestIds(next http.Handler) http.Handler {
+	if *requestIdHeader == "" {
+		return next
+	}
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(*requestIdHeader)
+		if !validRequestId(id) {
+			id = newRequestId()
+		}
+		w.Header().Set(*requestIdHeader, id)
+		w.Header().Add("Access-Control-Expose-Headers", *requestIdHeader)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIdKey{}, id)))
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+// validRequestId accepts ids from clients that are short and printable, so
+// they can't garble the logs.
+func validRequestId(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestId() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// requestId returns the id of the request ctx belongs to, or "-" outside a
+// request or with -request-id-header empty.
+func requestId(ctx context.Context) string {
+	if id, ok := ctx.Value(requestIdKey{}).(string); ok {
+		return id
+	}
+	return "-"
+}
+
+// storageFailure reports whether err is storage going wrong, as opposed to
+// the errors handlers answer with a 4xx, 501 or, for ErrCircuitOpen, which is
+// the breaker rather than storage, 503.
+func storageFailure(err error) bool {
+	return err != nil && errorStatus(err) == http.StatusInternalServerError
+}
+
+// loggedTodoService logs storage failures with the id of the request they
+// happened in.
+type loggedTodoService struct {
+	svc TodoService
+	id  string
+}
+
+func (t *loggedTodoService) check(op string, err error) error {
+	if storageFailure(err) {
+		log.Printf("storage %s: %v request=%s", op, err, t.id)
+	}
+	return err
+}
+
+func (t *loggedTodoService) GetAll() ([]*Todo, error) {
+	todos, err := t.svc.GetAll()
+	return todos, t.check("GetAll", err)
+}
+
+func (t *loggedTodoService) Get(id int) (*Todo, error) {
+	todo, err := t.svc.Get(id)
+	return todo, t.check("Get", err)
+}
+
+func (t *loggedTodoService) GetMany(ids []int) ([]*Todo, error) {
+	todos, err := t.svc.GetMany(ids)
+	return todos, t.check("GetMany", err)
+}
+
+func (t *loggedTodoService) GetByTag(tag string) ([]*Todo, error) {
+	todos, err := t.svc.GetByTag(tag)
+	return todos, t.check("GetByTag", err)
+}
+
+func (t *loggedTodoService) GetChangedSince(since time.Time) ([]*Todo, error) {
+	todos, err := t.svc.GetChangedSince(since)
+	return todos, t.check("GetChangedSince", err)
+}
+
+func (t *loggedTodoService) GetChangedAfterSeq(seq int64) ([]*Todo, error) {
+	todos, err := t.svc.GetChangedAfterSeq(seq)
+	return todos, t.check("GetChangedAfterSeq", err)
+}
+
+func (t *loggedTodoService) Snapshot() ([]*Todo, error) {
+	todos, err := t.svc.Snapshot()
+	return todos, t.check("Snapshot", err)
+}
+
+func (t *loggedTodoService) CollectionVersion() (uint64, error) {
+	version, err := t.svc.CollectionVersion()
+	return version, t.check("CollectionVersion", err)
+}
+
+func (t *loggedTodoService) Count() (int, error) {
+	n, err := t.svc.Count()
+	return n, t.check("Count", err)
+}
+
+func (t *loggedTodoService) ExistsByTitle(title string, except int) (bool, error) {
+	exists, err := t.svc.ExistsByTitle(title, except)
+	return exists, t.check("ExistsByTitle", err)
+}
+
+func (t *loggedTodoService) Stats() (TodoStats, error) {
+	stats, err := t.svc.Stats()
+	return stats, t.check("Stats", err)
+}
+
+func (t *loggedTodoService) TagCounts() ([]TagCount, error) {
+	tags, err := t.svc.TagCounts()
+	return tags, t.check("TagCounts", err)
+}
+
+func (t *loggedTodoService) TagSummaries() ([]TagSummary, error) {
+	summaries, err := t.svc.TagSummaries()
+	return summaries, t.check("TagSummaries", err)
+}
+
+func (t *loggedTodoService) Purge(before time.Time) (int, error) {
+	n, err := t.svc.Purge(before)
+	return n, t.check("Purge", err)
+}
+
+func (t *loggedTodoService) Subtasks(id int) ([]*Todo, error) {
+	todos, err := t.svc.Subtasks(id)
+	return todos, t.check("Subtasks", err)
+}
+
+func (t *loggedTodoService) History(id, offset, limit int) ([]*Todo, int, error) {
+	versions, total, err := t.svc.History(id, offset, limit)
+	return versions, total, t.check("History", err)
+}
+
+func (t *loggedTodoService) Save(todo *Todo) error {
+	return t.check("Save", t.svc.Save(todo))
+}
+
+func (t *loggedTodoService) Create(todo *Todo) error {
+	return t.check("Create", t.svc.Create(todo))
+}
+
+func (t *loggedTodoService) Upsert(todo *Todo) (bool, error) {
+	created, err := t.svc.Upsert(todo)
+	return created, t.check("Upsert", err)
+}
+
+func (t *loggedTodoService) ArchiveCompleted() (int, error) {
+	n, err := t.svc.ArchiveCompleted()
+	return n, t.check("ArchiveCompleted", err)
+}
+
+func (t *loggedTodoService) Reorder(ids []int, complete bool) ([]*Todo, error) {
+	todos, err := t.svc.Reorder(ids, complete)
+	return todos, t.check("Reorder", err)
+}
+
+func (t *loggedTodoService) Move(id, anchor int, after bool) (*Todo, bool, error) {
+	todo, moved, err := t.svc.Move(id, anchor, after)
+	return todo, moved, t.check("Move", err)
+}
+
+func (t *loggedTodoService) RenormalizeOrder(minGap float64) (bool, error) {
+	changed, err := t.svc.RenormalizeOrder(minGap)
+	return changed, t.check("RenormalizeOrder", err)
+}
+
+func (t *loggedTodoService) DeleteAll() error {
+	return t.check("DeleteAll", t.svc.DeleteAll())
+}
+
+func (t *loggedTodoService) DeleteWhere(filter TodoFilter) (int, error) {
+	n, err := t.svc.DeleteWhere(filter)
+	return n, t.check("DeleteWhere", err)
+}
+
+func (t *loggedTodoService) Delete(id int) error {
+	return t.check("Delete", t.svc.Delete(id))
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// JSON-RPC 2.0 over POST /rpc, as an alternative to the REST routes. The
+// methods map onto the same storage and checks:
+//
+//	todo.list                                  the todos GET /todos lists
+//	todo.get    {"id": <id>}                   one todo
+//	todo.create {<todo>}                       as POST /todos, id included
+//	todo.update {"id": <id>, "todo": {<todo>}} as PATCH /todos/{id}
+//	todo.delete {"id": <id>}                   as DELETE /todos/{id}
+//
+// Todos in results carry their "id". A batch is run in order.
+
+type rpcRequest struct {
+	Version string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+	Id      json.RawMessage `json:"id"` // Absent for notifications
+}
+
+type rpcResponse struct {
+	Version string          `json:"jsonrpc"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+	Id      json.RawMessage `json:"id"`
+}
+
+type rpcError struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+// Error codes from the JSON-RPC spec, then this server's own.
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcInternalError  = -32603
+
+	rpcNotFound = -32001
+	rpcConflict = -32002
+	rpcReadOnly = -32003
+)
+
+// rpcTodo is a todo as JSON-RPC results show it, with its id.
+type rpcTodo struct {
+	Id json.RawMessage `json:"id"`
+	*Todo
+}
+
+var rpcMethods = map[string]func(r *http.Request, params json.RawMessage) (interface{}, *rpcError){
+	"todo.list":   rpcList,
+	"todo.get":    rpcGet,
+	"todo.create": rpcCreate,
+	"todo.update": rpcUpdate,
+	"todo.delete": rpcDelete,
+}
+
+func rpcHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, r, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if maxErr := (*http.MaxBytesError)(nil); errors.As(err, &maxErr) {
+		writeError(w, r, fmt.Sprintf("request body is over the %d byte limit", maxErr.Limit), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 || body[0] != '[' {
+		if response := callRpc(r, body); response != nil {
+			json.NewEncoder(w).Encode(response)
+		} else {
+			w.WriteHeader(http.StatusNoContent) // Only a notification
+		}
+		return
+	}
+
+	var batch []json.RawMessage
+	if err := json.Unmarshal(body, &batch); err != nil {
+		json.NewEncoder(w).Encode(rpcFailure(nil, rpcParseError, err.Error()))
+		return
+	}
+	if len(batch) == 0 {
+		json.NewEncoder(w).Encode(rpcFailure(nil, rpcInvalidRequest, "empty batch"))
+		return
+	}
+	responses := make([]*rpcResponse, 0, len(batch))
+	for _, call := range batch {
+		if response := callRpc(r, call); response != nil {
+			responses = append(responses, response)
+		}
+	}
+	if len(responses) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	json.NewEncoder(w).Encode(responses)
+}
+
+// callRpc runs one request, returning its response or nil for a notification.
+func callRpc(r *http.Request, body []byte) *rpcResponse {
+	var req rpcRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		var syntax *json.SyntaxError
+		if errors.As(err, &syntax) || len(body) == 0 {
+			return rpcFailure(nil, rpcParseError, "invalid JSON")
+		}
+		return rpcFailure(nil, rpcInvalidRequest, err.Error())
+	}
+	if req.Version != "2.0" || req.Method == "" {
+		return rpcFailure(req.Id, rpcInvalidRequest, `want "jsonrpc": "2.0" and a method`)
+	}
+
+	var result interface{}
+	var rerr *rpcError
+	if method, ok := rpcMethods[req.Method]; ok {
+		result, rerr = method(r, req.Params)
+	} else {
+		rerr = &rpcError{Code: rpcMethodNotFound, Message: fmt.Sprintf("no method %q", req.Method)}
+	}
+	if len(req.Id) == 0 {
+		return nil
+	}
+	if rerr != nil {
+		return &rpcResponse{Version: "2.0", Error: rerr, Id: req.Id}
+	}
+	return &rpcResponse{Version: "2.0", Result: result, Id: req.Id}
+}
+
+func rpcFailure(id json.RawMessage, code int, message string) *rpcResponse {
+	if len(id) == 0 {
+		id = json.RawMessage("null")
+	}
+	return &rpcResponse{Version: "2.0", Error: &rpcError{Code: code, Message: message}, Id: id}
+}
+
+// rpcStorageError converts a storage error to its JSON-RPC error.
+func rpcStorageError(err error) *rpcError {
+	switch {
+	case errors.Is(err, ErrConflict):
+		return &rpcError{Code: rpcConflict, Message: err.Error()}
+	case errors.Is(err, ErrValidation):
+		return &rpcError{Code: rpcInvalidParams, Message: err.Error()}
+	case errors.Is(err, ErrNotFound):
+		return &rpcError{Code: rpcNotFound, Message: err.Error()}
+	case errors.Is(err, ErrReadOnly):
+		return &rpcError{Code: rpcReadOnly, Message: err.Error()}
+	}
+	return &rpcError{Code: rpcInternalError, Message: err.Error()}
+}
+
+// rpcWritable returns an error while in read-only mode.
+func rpcWritable() *rpcError {
+	if readOnly.Load() {
+		return rpcStorageError(ErrReadOnly)
+	}
+	return nil
+}
+
+func rpcTodos(r *http.Request, todos ...*Todo) []rpcTodo {
+	prepareTodos(r, todos...)
+	shown := make([]rpcTodo, len(todos))
+	for i, todo := range todos {
+		shown[i] = rpcTodo{Id: jsonId(todo.Id), Todo: todo}
+	}
+	return shown
+}
+
+// rpcParams decodes params into v, checking them against schema if given.
+func rpcParams(params json.RawMessage, schema *jsonSchema, v interface{}) *rpcError {
+	if len(params) == 0 {
+		return &rpcError{Code: rpcInvalidParams, Message: "params are required"}
+	}
+	if schema != nil {
+		violations, err := checkSchema(params, schema)
+		if err != nil {
+			return &rpcError{Code: rpcInvalidParams, Message: err.Error()}
+		}
+		if len(violations) > 0 {
+			return &rpcError{Code: rpcInvalidParams, Message: "params do not match schema", Data: violations}
+		}
+	}
+	if err := json.Unmarshal(params, v); err != nil {
+		return &rpcError{Code: rpcInvalidParams, Message: err.Error()}
+	}
+	return nil
+}
+
+// rpcId decodes the "id" of params.
+func rpcId(raw json.RawMessage) (int, *rpcError) {
+	if len(raw) == 0 {
+		return 0, &rpcError{Code: rpcInvalidParams, Message: "id is required"}
+	}
+	id, err := decodeJsonId(raw)
+	if err != nil {
+		return 0, &rpcError{Code: rpcInvalidParams, Message: "invalid id"}
+	}
+	return id, nil
+}
+
+// rpcTitleTaken returns a conflict if checkTitle fails.
+func rpcTitleTaken(r *http.Request, title string, except int) *rpcError {
+	if err := checkTitle(r, title, except); err != nil {
+		return rpcStorageError(err)
+	}
+	return nil
+}
+
+func rpcList(r *http.Request, params json.RawMessage) (interface{}, *rpcError) {
+	todos, err := storageFor(r).GetAll()
+	if err != nil {
+		return nil, rpcStorageError(err)
+	}
+	return rpcTodos(r, topLevelOnly(archivedOnly(todos, false))...), nil
+}
+
+func rpcGet(r *http.Request, params json.RawMessage) (interface{}, *rpcError) {
+	var p struct {
+		Id json.RawMessage `json:"id"`
+	}
+	if rerr := rpcParams(params, nil, &p); rerr != nil {
+		return nil, rerr
+	}
+	id, rerr := rpcId(p.Id)
+	if rerr != nil {
+		return nil, rerr
+	}
+	todo, err := storageFor(r).Get(id)
+	if err != nil {
+		return nil, rpcStorageError(err)
+	}
+	if todo == nil {
+		return nil, &rpcError{Code: rpcNotFound, Message: "not found"}
+	}
+	return rpcTodos(r, todo)[0], nil
+}
+
+func rpcCreate(r *http.Request, params json.RawMessage) (interface{}, *rpcError) {
+	if rerr := rpcWritable(); rerr != nil {
+		return nil, rerr
+	}
+	p := struct {
+		Todo
+		Id json.RawMessage `json:"id"`
+	}{
+		Todo: *newTodo(),
+	}
+	if rerr := rpcParams(params, createTodoSchema, &p); rerr != nil {
+		return nil, rerr
+	}
+	todo := p.Todo
+	if len(p.Id) > 0 && string(p.Id) != "null" {
+		id, rerr := rpcId(p.Id)
+		if rerr != nil {
+			return nil, rerr
+		}
+		todo.Id = id
+	}
+	if _, err := checkLimits(&todo); err != nil {
+		return nil, &rpcError{Code: rpcInvalidParams, Message: err.Error()}
+	}
+	if rerr := rpcTitleTaken(r, todo.Title, todo.Id); rerr != nil {
+		return nil, rerr
+	}
+	if err := storageFor(r).Create(&todo); err != nil {
+		return nil, rpcStorageError(err)
+	}
+	return rpcTodos(r, &todo)[0], nil
+}
+
+func rpcUpdate(r *http.Request, params json.RawMessage) (interface{}, *rpcError) {
+	if rerr := rpcWritable(); rerr != nil {
+		return nil, rerr
+	}
+	var p struct {
+		Id   json.RawMessage `json:"id"`
+		Todo json.RawMessage `json:"todo"`
+	}
+	if rerr := rpcParams(params, nil, &p); rerr != nil {
+		return nil, rerr
+	}
+	id, rerr := rpcId(p.Id)
+	if rerr != nil {
+		return nil, rerr
+	}
+	var patch json.RawMessage
+	if rerr := rpcParams(p.Todo, updateTodoSchema, &patch); rerr != nil {
+		return nil, rerr
+	}
+
+	stored, err := storageFor(r).Get(id)
+	if err != nil {
+		return nil, rpcStorageError(err)
+	}
+	if stored == nil {
+		return nil, &rpcError{Code: rpcNotFound, Message: "not found"}
+	}
+	todo, err := mergePatch(stored, patch)
+	if err != nil {
+		return nil, &rpcError{Code: rpcInvalidParams, Message: err.Error()}
+	}
+	if _, err := checkLimits(todo); err != nil {
+		return nil, &rpcError{Code: rpcInvalidParams, Message: err.Error()}
+	}
+	// As with PATCH, an update that changes nothing isn't written.
+	if sameTodo(stored, todo) && (todo.Version == 0 || todo.Version == stored.Version) {
+		return rpcTodos(r, stored)[0], nil
+	}
+	if stored.Title != todo.Title {
+		if rerr := rpcTitleTaken(r, todo.Title, id); rerr != nil {
+			return nil, rerr
+		}
+	}
+	if err := storageFor(r).Save(todo); err != nil {
+		return nil, rpcStorageError(err)
+	}
+	return rpcTodos(r, todo)[0], nil
+}
+
+func rpcDelete(r *http.Request, params json.RawMessage) (interface{}, *rpcError) {
+	if rerr := rpcWritable(); rerr != nil {
+		return nil, rerr
+	}
+	var p struct {
+		Id json.RawMessage `json:"id"`
+	}
+	if rerr := rpcParams(params, nil, &p); rerr != nil {
+		return nil, rerr
+	}
+	id, rerr := rpcId(p.Id)
+	if rerr != nil {
+		return nil, rerr
+	}
+	if err := storageFor(r).Delete(id); err != nil {
+		return nil, rpcStorageError(err)
+	}
+	return true, nil
+}
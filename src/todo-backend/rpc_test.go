@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestIdenticalRpcUpdateDoesNotWrite(t *testing.T) {
+	fake := NewFakeClock(time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC))
+	store := useStore(t)
+	store.Clock = fake
+	todo := &Todo{Title: "walk the dog"}
+	if err := store.Save(todo); err != nil {
+		t.Fatal(err)
+	}
+
+	fake.Advance(time.Minute)
+	w := send("POST", "/rpc", `{"jsonrpc":"2.0","method":"todo.update","params":{"id":1,"todo":{"title":"walk the dog"}},"id":1}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("todo.update: %d %s", w.Code, w.Body)
+	}
+	stored, _ := store.Get(1)
+	if !stored.UpdatedAt.Equal(todo.UpdatedAt) || stored.Version != todo.Version {
+		t.Fatalf("identical todo.update wrote the todo: updatedAt %v to %v, version %d to %d: %s",
+			todo.UpdatedAt, stored.UpdatedAt, todo.Version, stored.Version, w.Body)
+	}
+}
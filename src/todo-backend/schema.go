@@ -0,0 +1,151 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"unicode/utf8"
+)
+
+//go:embed schema/*.json
+var schemaFiles embed.FS
+
+// jsonSchema is the subset of JSON Schema used by the files in schema/.
+type jsonSchema struct {
+	Type                 schemaTypes            `json:"type"`
+	Properties           map[string]*jsonSchema `json:"properties"`
+	Required             []string               `json:"required"`
+	AdditionalProperties *bool                  `json:"additionalProperties"`
+	Items                *jsonSchema            `json:"items"`
+	MinLength            *int                   `json:"minLength"`
+	MaxLength            *int                   `json:"maxLength"`
+	Minimum              *float64               `json:"minimum"`
+}
+
+// schemaTypes accepts "type" as either a single name or a list of them.
+type schemaTypes []string
+
+func (s *schemaTypes) UnmarshalJSON(b []byte) error {
+	var one string
+	if err := json.Unmarshal(b, &one); err == nil {
+		*s = schemaTypes{one}
+		return nil
+	}
+	return json.Unmarshal(b, (*[]string)(s))
+}
+
+var (
+	createTodoSchema = mustLoadSchema("schema/todo-create.json")
+	updateTodoSchema = mustLoadSchema("schema/todo-update.json")
+	moveTodoSchema   = mustLoadSchema("schema/todo-move.json")
+	orderTodosSchema = mustLoadSchema("schema/todo-order.json")
+)
+
+func mustLoadSchema(name string) *jsonSchema {
+	b, err := schemaFiles.ReadFile(name)
+	if err != nil {
+		panic(err)
+	}
+	s := new(jsonSchema)
+	if err := json.Unmarshal(b, s); err != nil {
+		panic(fmt.Sprintf("%s: %v", name, err))
+	}
+	return s
+}
+
+// validate checks a value decoded with json.Decoder.UseNumber against the
+// schema, returning a description of each violation.
+func (s *jsonSchema) validate(v interface{}) []string {
+	return s.check("", v, nil)
+}
+
+func (s *jsonSchema) check(path string, v interface{}, errs []string) []string {
+	at := path
+	if at == "" {
+		at = "/"
+	}
+
+	if len(s.Type) > 0 && !s.Type.match(v) {
+		return append(errs, fmt.Sprintf("%s: expected %s, got %s", at, s.Type, jsonType(v)))
+	}
+
+	switch v := v.(type) {
+	case string:
+		n := utf8.RuneCountInString(v)
+		if s.MinLength != nil && n < *s.MinLength {
+			errs = append(errs, fmt.Sprintf("%s: length must be at least %d", at, *s.MinLength))
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			errs = append(errs, fmt.Sprintf("%s: length must be at most %d", at, *s.MaxLength))
+		}
+	case json.Number:
+		if f, err := v.Float64(); err == nil && s.Minimum != nil && f < *s.Minimum {
+			errs = append(errs, fmt.Sprintf("%s: must be at least %v", at, *s.Minimum))
+		}
+	case []interface{}:
+		if s.Items != nil {
+			for i, item := range v {
+				errs = s.Items.check(path+"/"+strconv.Itoa(i), item, errs)
+			}
+		}
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				errs = append(errs, fmt.Sprintf("%s: missing required property %q", at, name))
+			}
+		}
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names) // Report violations in a stable order
+		for _, name := range names {
+			if prop, ok := s.Properties[name]; ok {
+				errs = prop.check(path+"/"+name, v[name], errs)
+			} else if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+				errs = append(errs, fmt.Sprintf("%s: unknown property %q", at, name))
+			}
+		}
+	}
+	return errs
+}
+
+func (t schemaTypes) match(v interface{}) bool {
+	for _, name := range t {
+		if name == jsonType(v) || (name == "number" && jsonType(v) == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+func (t schemaTypes) String() string {
+	if len(t) == 1 {
+		return t[0]
+	}
+	return fmt.Sprint([]string(t))
+}
+
+func jsonType(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case json.Number:
+		if f, err := v.Float64(); err == nil && f == math.Trunc(f) {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
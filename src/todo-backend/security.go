@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// With -security-log, requests turned away for who is asking or how much
+// they ask for (401, 403, 413 and 429 responses) are also written there, one
+// JSON object per line, for intrusion detection to read. Unlike the access
+// log it isn't sampled or filtered.
+
+// securityStatuses are the responses logged as security events.
+var securityStatuses = map[int]bool{
+	http.StatusUnauthorized:          true,
+	http.StatusForbidden:             true,
+	http.StatusRequestEntityTooLarge: true,
+	http.StatusTooManyRequests:       true,
+}
+
+// securityEvent is one line of the security log.
+type securityEvent struct {
+	Time         time.Time `json:"time"`
+	Status       int       `json:"status"`
+	Reason       string    `json:"reason"`
+	Client       string    `json:"client"`
+	ForwardedFor string    `json:"forwardedFor,omitempty"` // As sent, so unverified
+	Method       string    `json:"method"`
+	Path         string    `json:"path"`
+	UserAgent    string    `json:"userAgent,omitempty"`
+	Request      string    `json:"request"`
+}
+
+// SecurityLog receives security events, or is nil without -security-log.
+var SecurityLog *log.Logger
+
+// openSecurityLog opens -security-log: "-" for stderr, or a file to append
+// to.
+func openSecurityLog(path string) (*log.Logger, error) {
+	if path == "-" {
+		return log.New(os.Stderr, "", 0), nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+	return log.New(f, "", 0), nil
+}
+
+type denialKey struct{}
+
+// denial is where writeError leaves the message it answered with, for the
+// security log to give as the reason.
+type denial struct {
+	m      sync.Mutex
+	reason string
+}
+
+// noteDenial records the error message a request is answered with, if the
+// security log is watching it.
+func noteDenial(ctx context.Context, reason string) {
+	if d, ok := ctx.Value(denialKey{}).(*denial); ok {
+		d.m.Lock()
+		d.reason = reason
+		d.m.Unlock()
+	}
+}
+
+// logSecurityEvents writes the requests answered with a securityStatuses
+// status to SecurityLog.
+func logSecurityEvents(next http.Handler) http.Handler {
+	if SecurityLog == nil {
+		return next
+	}
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		d := new(denial)
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), denialKey{}, d)))
+		if !securityStatuses[rec.status] {
+			return
+		}
+
+		d.m.Lock()
+		reason := d.reason
+		d.m.Unlock()
+		if reason == "" {
+			reason = http.StatusText(rec.status)
+		}
+		line, _ := json.Marshal(securityEvent{
+			Time:         clock.Now().UTC(),
+			Status:       rec.status,
+			Reason:       reason,
+			Client:       clientIP(r),
+			ForwardedFor: r.Header.Get("X-Forwarded-For"),
+			Method:       r.Method,
+			Path:         r.URL.Path,
+			UserAgent:    r.UserAgent(),
+			Request:      requestId(r.Context()),
+		})
+		SecurityLog.Print(string(line))
+	}
+
+	return http.HandlerFunc(fn)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+)
+
+// seedTodos loads a JSON array of todos from path into TodoSvc. Unless force
+// is set it does nothing when the store already has todos, so restarting
+// with a persistent backend doesn't duplicate them.
+func seedTodos(path string, force bool) error {
+	if !force {
+		n, err := TodoSvc.Count()
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			log.Printf("store has %d todos, not seeding from %s", n, path)
+			return nil
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var todos []*Todo
+	if err := json.NewDecoder(f).Decode(&todos); err != nil {
+		return err
+	}
+	for i, todo := range todos {
+		todo.Id = 0 // Ids are assigned by the store
+		if err := TodoSvc.Save(todo); err != nil {
+			return fmt.Errorf("todo %d: %v", i, err)
+		}
+	}
+	log.Printf("loaded %d todos from %s", len(todos), path)
+	return nil
+}
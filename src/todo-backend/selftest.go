@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// selftestCheck is one assertion of the Todo-Backend spec, returning why it
+// failed or nil.
+type selftestCheck struct {
+	name string
+	run  func(c *selftestClient) error
+}
+
+// selftestClient talks to the server under test and carries what one check
+// leaves for the next, such as the url of the todo it created.
+type selftestClient struct {
+	http *http.Client
+	root string
+	url  string
+}
+
+// do sends a request with an optional JSON body, decoding a JSON response
+// into out when given, and returns the status.
+func (c *selftestClient) do(method, url string, body, out interface{}) (int, error) {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		reader = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, url, reader)
+	if err != nil {
+		return 0, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if out != nil && resp.StatusCode < 300 {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp.StatusCode, fmt.Errorf("%s %s: decoding response: %v", method, url, err)
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+// expect returns an error unless status is one of want.
+func expect(method, url string, status int, want ...int) error {
+	for _, w := range want {
+		if status == w {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s %s answered %d, want %d", method, url, status, want[0])
+}
+
+func (c *selftestClient) list() ([]Todo, error) {
+	var todos []Todo
+	status, err := c.do("GET", c.root, nil, &todos)
+	if err != nil {
+		return nil, err
+	}
+	return todos, expect("GET", c.root, status, http.StatusOK)
+}
+
+// selftestChecks follow the Todo-Backend spec suite, in order.
+var selftestChecks = []selftestCheck{
+	{"the api root responds to a GET", func(c *selftestClient) error {
+		_, err := c.list()
+		return err
+	}},
+	{"the api root responds to a DELETE", func(c *selftestClient) error {
+		status, err := c.do("DELETE", c.root, nil, nil)
+		if err != nil {
+			return err
+		}
+		return expect("DELETE", c.root, status, http.StatusNoContent, http.StatusOK)
+	}},
+	{"after a DELETE the api root responds to a GET with an empty array", func(c *selftestClient) error {
+		todos, err := c.list()
+		if err == nil && len(todos) != 0 {
+			err = fmt.Errorf("got %d todos, want none", len(todos))
+		}
+		return err
+	}},
+	{"a POST creates a todo and returns it with a url", func(c *selftestClient) error {
+		var todo Todo
+		status, err := c.do("POST", c.root, map[string]interface{}{"title": "selftest"}, &todo)
+		if err != nil {
+			return err
+		}
+		if err := expect("POST", c.root, status, http.StatusCreated, http.StatusOK); err != nil {
+			return err
+		}
+		switch {
+		case todo.Title != "selftest":
+			return fmt.Errorf("created todo has title %q", todo.Title)
+		case todo.Completed:
+			return fmt.Errorf("created todo is already completed")
+		case todo.Url == "":
+			return fmt.Errorf("created todo has no url")
+		}
+		c.url = todo.Url
+		return nil
+	}},
+	{"the created todo is listed at the api root", func(c *selftestClient) error {
+		todos, err := c.list()
+		if err == nil && (len(todos) != 1 || todos[0].Url != c.url) {
+			err = fmt.Errorf("got %d todos, want just the created one", len(todos))
+		}
+		return err
+	}},
+	{"the created todo can be fetched from its url", func(c *selftestClient) error {
+		var todo Todo
+		status, err := c.do("GET", c.url, nil, &todo)
+		if err == nil {
+			err = expect("GET", c.url, status, http.StatusOK)
+		}
+		if err == nil && todo.Title != "selftest" {
+			err = fmt.Errorf("fetched todo has title %q", todo.Title)
+		}
+		return err
+	}},
+	{"a PATCH to a todo's url updates it", func(c *selftestClient) error {
+		patch := map[string]interface{}{"title": "selftest, changed", "completed": true, "order": 5}
+		var todo Todo
+		status, err := c.do("PATCH", c.url, patch, &todo)
+		if err == nil {
+			err = expect("PATCH", c.url, status, http.StatusOK)
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := c.do("GET", c.url, nil, &todo); err != nil {
+			return err
+		}
+		if todo.Title != "selftest, changed" || !todo.Completed || todo.Order != 5 {
+			return fmt.Errorf("fetched todo after PATCH is %q, completed %v, order %v", todo.Title, todo.Completed, todo.Order)
+		}
+		return nil
+	}},
+	{"a DELETE to a todo's url removes it", func(c *selftestClient) error {
+		status, err := c.do("DELETE", c.url, nil, nil)
+		if err == nil {
+			err = expect("DELETE", c.url, status, http.StatusNoContent, http.StatusOK)
+		}
+		if err != nil {
+			return err
+		}
+		if status, err = c.do("GET", c.url, nil, nil); err != nil {
+			return err
+		}
+		if err := expect("GET", c.url, status, http.StatusNotFound); err != nil {
+			return err
+		}
+		todos, err := c.list()
+		if err == nil && len(todos) != 0 {
+			err = fmt.Errorf("got %d todos after deleting, want none", len(todos))
+		}
+		return err
+	}},
+	{"a todo can be created with an order, which it is fetched with", func(c *selftestClient) error {
+		var todo Todo
+		status, err := c.do("POST", c.root, map[string]interface{}{"title": "selftest order", "order": 523}, &todo)
+		if err == nil {
+			err = expect("POST", c.root, status, http.StatusCreated, http.StatusOK)
+		}
+		if err != nil {
+			return err
+		}
+		if todo.Order != 523 {
+			return fmt.Errorf("created todo has order %v, want 523", todo.Order)
+		}
+		c.url = todo.Url
+		if _, err := c.do("GET", c.url, nil, &todo); err != nil {
+			return err
+		}
+		if todo.Order != 523 {
+			return fmt.Errorf("fetched todo has order %v, want 523", todo.Order)
+		}
+		return nil
+	}},
+	{"a PATCH of just the order changes it and nothing else", func(c *selftestClient) error {
+		status, err := c.do("PATCH", c.url, map[string]interface{}{"order": 95}, nil)
+		if err == nil {
+			err = expect("PATCH", c.url, status, http.StatusOK)
+		}
+		if err != nil {
+			return err
+		}
+		var todo Todo
+		if _, err := c.do("GET", c.url, nil, &todo); err != nil {
+			return err
+		}
+		if todo.Order != 95 || todo.Title != "selftest order" {
+			return fmt.Errorf("fetched todo after PATCH is %q with order %v", todo.Title, todo.Order)
+		}
+		status, err = c.do("DELETE", c.url, nil, nil)
+		if err == nil {
+			err = expect("DELETE", c.url, status, http.StatusNoContent, http.StatusOK)
+		}
+		return err
+	}},
+}
+
+// runSelftest runs selftestChecks against the todos collection at root,
+// printing PASS or FAIL for each, and reports whether all passed. It deletes
+// every todo there, so it is only for test deployments. A failed check skips
+// the ones after it, which depend on it.
+func runSelftest(root string, out io.Writer) bool {
+	c := &selftestClient{
+		http: &http.Client{Timeout: 10 * time.Second},
+		root: strings.TrimSuffix(root, "/"),
+	}
+	for i, check := range selftestChecks {
+		if err := check.run(c); err != nil {
+			fmt.Fprintf(out, "FAIL %s: %v\n", check.name, err)
+			for _, skipped := range selftestChecks[i+1:] {
+				fmt.Fprintf(out, "SKIP %s\n", skipped.name)
+			}
+			return false
+		}
+		fmt.Fprintf(out, "PASS %s\n", check.name)
+	}
+	return true
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// shuttingDown is set once shutdown starts, failing /readyz.
+var shuttingDown atomic.Bool
+
+// pollGroup tracks the long-polls waiting for a change so shutdown can end
+// them and wait for their responses before the process exits.
+type pollGroup struct {
+	m        sync.Mutex
+	wg       sync.WaitGroup
+	closing  chan struct{} // Closed when shutdown starts
+	shutdown bool
+}
+
+// LongPolls are the GET /todos?wait= requests in progress.
+var LongPolls = &pollGroup{closing: make(chan struct{})}
+
+// join registers a long-poll, returning a channel closed when shutdown starts,
+// or false if it already has and the poll shouldn't wait. A successful join
+// must be followed by leave.
+func (g *pollGroup) join() (<-chan struct{}, bool) {
+	g.m.Lock()
+	defer g.m.Unlock()
+	if g.shutdown {
+		return nil, false
+	}
+	g.wg.Add(1)
+	return g.closing, true
+}
+
+func (g *pollGroup) leave() {
+	g.wg.Done()
+}
+
+// close tells the waiting long-polls to finish and refuses new ones.
+func (g *pollGroup) close() {
+	g.m.Lock()
+	defer g.m.Unlock()
+	if !g.shutdown {
+		g.shutdown = true
+		close(g.closing)
+	}
+}
+
+// wait blocks until every long-poll has left or ctx is done.
+func (g *pollGroup) wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		g.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// serve runs server on ln until it fails or the process gets SIGINT or
+// SIGTERM. It then fails /readyz and goes on serving for -shutdown-delay,
+// ends the long-polls, which answer 503 so clients poll again elsewhere,
+// stops accepting connections and waits up to -drain-timeout for requests in
+// progress before dropping them.
+func serve(server *http.Server, ln net.Listener) error {
+	errs := make(chan error, 1)
+	go func() { errs <- server.Serve(ln) }()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	select {
+	case err := <-errs:
+		return err
+	case sig := <-stop:
+		log.Printf("received %v, shutting down", sig)
+	}
+
+	// Load balancers take a while to notice /readyz failing; until they
+	// do, requests keep coming and are served as usual.
+	shuttingDown.Store(true)
+	if *shutdownDelay > 0 {
+		log.Printf("waiting %v for load balancers to stop routing here", *shutdownDelay)
+		time.Sleep(*shutdownDelay)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *drainTimeout)
+	defer cancel()
+	LongPolls.close()
+	if err := LongPolls.wait(ctx); err != nil {
+		log.Printf("long-polls still open after %v", *drainTimeout)
+	}
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("requests still open after %v, closing them", *drainTimeout)
+		return server.Close()
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// slowTodoService logs a warning for each storage call that takes longer than
+// -slow-query-threshold, with the request it was made for.
+type slowTodoService struct {
+	svc       TodoService
+	threshold time.Duration
+	request   string
+}
+
+// warn logs the call op if it has run over the threshold since start. id is
+// the todo it was for, or 0 if it wasn't for one.
+func (t *slowTodoService) warn(op string, id int, start time.Time) {
+	elapsed := time.Since(start)
+	if elapsed <= t.threshold {
+		return
+	}
+	if id != 0 {
+		log.Printf("slow storage call %s id=%s took %v request=%s", op, encodeId(id), elapsed, t.request)
+	} else {
+		log.Printf("slow storage call %s took %v request=%s", op, elapsed, t.request)
+	}
+}
+
+// warnTodo is warn for calls taking a todo, whose id an insert only has once
+// it is done.
+func (t *slowTodoService) warnTodo(op string, todo *Todo, start time.Time) {
+	t.warn(op, todo.Id, start)
+}
+
+func (t *slowTodoService) GetAll() ([]*Todo, error) {
+	defer t.warn("GetAll", 0, time.Now())
+	return t.svc.GetAll()
+}
+
+func (t *slowTodoService) Get(id int) (*Todo, error) {
+	defer t.warn("Get", id, time.Now())
+	return t.svc.Get(id)
+}
+
+func (t *slowTodoService) GetMany(ids []int) ([]*Todo, error) {
+	defer t.warn("GetMany", 0, time.Now())
+	return t.svc.GetMany(ids)
+}
+
+func (t *slowTodoService) GetByTag(tag string) ([]*Todo, error) {
+	defer t.warn("GetByTag", 0, time.Now())
+	return t.svc.GetByTag(tag)
+}
+
+func (t *slowTodoService) GetChangedSince(since time.Time) ([]*Todo, error) {
+	defer t.warn("GetChangedSince", 0, time.Now())
+	return t.svc.GetChangedSince(since)
+}
+
+func (t *slowTodoService) GetChangedAfterSeq(seq int64) ([]*Todo, error) {
+	defer t.warn("GetChangedAfterSeq", 0, time.Now())
+	return t.svc.GetChangedAfterSeq(seq)
+}
+
+func (t *slowTodoService) Snapshot() ([]*Todo, error) {
+	defer t.warn("Snapshot", 0, time.Now())
+	return t.svc.Snapshot()
+}
+
+func (t *slowTodoService) CollectionVersion() (uint64, error) {
+	defer t.warn("CollectionVersion", 0, time.Now())
+	return t.svc.CollectionVersion()
+}
+
+func (t *slowTodoService) Count() (int, error) {
+	defer t.warn("Count", 0, time.Now())
+	return t.svc.Count()
+}
+
+func (t *slowTodoService) ExistsByTitle(title string, except int) (bool, error) {
+	defer t.warn("ExistsByTitle", 0, time.Now())
+	return t.svc.ExistsByTitle(title, except)
+}
+
+func (t *slowTodoService) Stats() (TodoStats, error) {
+	defer t.warn("Stats", 0, time.Now())
+	return t.svc.Stats()
+}
+
+func (t *slowTodoService) Save(todo *Todo) error {
+	defer t.warnTodo("Save", todo, time.Now())
+	return t.svc.Save(todo)
+}
+
+func (t *slowTodoService) Create(todo *Todo) error {
+	defer t.warnTodo("Create", todo, time.Now())
+	return t.svc.Create(todo)
+}
+
+func (t *slowTodoService) Upsert(todo *Todo) (bool, error) {
+	defer t.warnTodo("Upsert", todo, time.Now())
+	return t.svc.Upsert(todo)
+}
+
+func (t *slowTodoService) Reorder(ids []int, complete bool) ([]*Todo, error) {
+	defer t.warn("Reorder", 0, time.Now())
+	return t.svc.Reorder(ids, complete)
+}
+
+func (t *slowTodoService) RenormalizeOrder(minGap float64) (bool, error) {
+	defer t.warn("RenormalizeOrder", 0, time.Now())
+	return t.svc.RenormalizeOrder(minGap)
+}
+
+func (t *slowTodoService) TagCounts() ([]TagCount, error) {
+	defer t.warn("TagCounts", 0, time.Now())
+	return t.svc.TagCounts()
+}
+
+func (t *slowTodoService) TagSummaries() ([]TagSummary, error) {
+	defer t.warn("TagSummaries", 0, time.Now())
+	return t.svc.TagSummaries()
+}
+
+func (t *slowTodoService) Subtasks(id int) ([]*Todo, error) {
+	defer t.warn("Subtasks", id, time.Now())
+	return t.svc.Subtasks(id)
+}
+
+func (t *slowTodoService) DeleteAll() error {
+	defer t.warn("DeleteAll", 0, time.Now())
+	return t.svc.DeleteAll()
+}
+
+func (t *slowTodoService) ArchiveCompleted() (int, error) {
+	defer t.warn("ArchiveCompleted", 0, time.Now())
+	return t.svc.ArchiveCompleted()
+}
+
+func (t *slowTodoService) Move(id, anchor int, after bool) (*Todo, bool, error) {
+	defer t.warn("Move", id, time.Now())
+	return t.svc.Move(id, anchor, after)
+}
+
+func (t *slowTodoService) DeleteWhere(filter TodoFilter) (int, error) {
+	defer t.warn("DeleteWhere", 0, time.Now())
+	return t.svc.DeleteWhere(filter)
+}
+
+func (t *slowTodoService) History(id, offset, limit int) ([]*Todo, int, error) {
+	defer t.warn("History", id, time.Now())
+	return t.svc.History(id, offset, limit)
+}
+
+func (t *slowTodoService) Delete(id int) error {
+	defer t.warn("Delete", id, time.Now())
+	return t.svc.Delete(id)
+}
+
+func (t *slowTodoService) Purge(before time.Time) (int, error) {
+	defer t.warn("Purge", 0, time.Now())
+	return t.svc.Purge(before)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+)
+
+// faviconHandler answers browsers' /favicon.ico requests with an empty 204
+// they may cache, instead of a 404 every time the API is opened in a tab.
+func faviconHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// indexRoutes are the endpoints the index page lists.
+var indexRoutes = []struct{ methods, path, about string }{
+	{"GET, HEAD, POST, DELETE", "/todos", "the todos"},
+	{"GET, PATCH, PUT, DELETE", "/todos/{id}", "one todo"},
+	{"GET, POST", "/todos/{id}/subtasks", "a todo's subtasks"},
+	{"GET", "/todos/{id}/history", "the versions a todo has been saved as"},
+	{"POST", "/todos/{id}/move", "place a todo before or after another"},
+	{"POST", "/todos/{id}/restore", "bring back a deleted todo"},
+	{"GET", "/todos/stats", "counts of completed and active todos"},
+	{"GET", "/todos/grouped", "todos grouped by a field"},
+	{"GET", "/todos/summary", "completed and total todos per tag"},
+	{"POST", "/todos/archive-completed", "archive every completed todo"},
+	{"POST", "/todos/undo", "revert the last change"},
+	{"PUT", "/todos/order", "put the todos in the order of a list of ids"},
+	{"GET", "/todos.ics", "an iCalendar feed of due todos"},
+	{"GET", "/tags", "the tags in use"},
+	{"GET", "/export", "a backup of every todo"},
+	{"POST", "/import", "load todos from a backup"},
+	{"POST", "/rpc", "JSON-RPC 2.0"},
+	{"GET", "/healthz", "storage health"},
+	{"GET", "/readyz", "readiness for traffic"},
+}
+
+// indexHandler serves a page at / listing the API's endpoints, when
+// -index-page is on, and a JSON 404 for any other path no route has.
+func indexHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" || !*indexPage {
+		writeError(w, r, "Not Found", http.StatusNotFound)
+		return
+	}
+	if r.Method != "GET" && r.Method != "HEAD" {
+		writeError(w, r, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var page strings.Builder
+	page.WriteString("<!DOCTYPE html>\n<title>Todo-Backend</title>\n<h1>Todo-Backend</h1>\n<table>\n")
+	for _, route := range indexRoutes {
+		path := html.EscapeString(*basePath + route.path)
+		if !strings.Contains(route.path, "{") && strings.HasPrefix(route.methods, "GET") {
+			path = fmt.Sprintf(`<a href="%s">%s</a>`, path, path)
+		}
+		fmt.Fprintf(&page, "<tr><td>%s</td><td>%s</td><td>%s</td></tr>\n", route.methods, path, route.about)
+	}
+	page.WriteString("</table>\n")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(page.String()))
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// subtasksHandler serves /todos/{id}/subtasks: GET lists the todo's subtasks
+// and POST creates one, as POST /todos would with the todo as its parent.
+// Subtasks are left out of GET /todos unless it has ?include=subtasks.
+func subtasksHandler(w http.ResponseWriter, r *http.Request, key string) {
+	if r.Method != "GET" && r.Method != "POST" {
+		writeError(w, r, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := decodeId(key)
+	if err != nil {
+		writeError(w, r, "Invalid Id", http.StatusBadRequest)
+		return
+	}
+	parent, err := storageFor(r).Get(id)
+	if err != nil {
+		writeStorageError(w, r, err)
+		return
+	}
+	if parent == nil {
+		writeError(w, r, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	if r.Method == "GET" {
+		todos, err := storageFor(r).Subtasks(id)
+		if err != nil {
+			writeStorageError(w, r, err)
+			return
+		}
+		if err := sortTodos(r, todos); err != nil {
+			writeError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		prepareTodos(r, todos...)
+		writeJsonMeta(w, todos, listMeta(len(todos)))
+		return
+	}
+
+	body := struct {
+		Todo
+		Id json.RawMessage `json:"id"`
+	}{
+		Todo: *newTodo(),
+	}
+	if !decodeBody(w, r, &body, createTodoSchema) || !validTodo(w, r, &body.Todo) {
+		return
+	}
+	todo := body.Todo
+	if len(body.Id) > 0 && string(body.Id) != "null" {
+		if todo.Id, err = decodeJsonId(body.Id); err != nil {
+			writeError(w, r, "Invalid Id", http.StatusBadRequest)
+			return
+		}
+	}
+	ref := todoRef(id)
+	todo.ParentId = &ref
+	if titleTaken(w, r, todo.Title, todo.Id) {
+		return
+	}
+	err = storageFor(r).Create(&todo)
+	switch err {
+	case nil:
+	case ErrDuplicateOrder:
+		writeError(w, r, "Another todo already has this order", http.StatusConflict)
+		return
+	case ErrAlreadyExists:
+		writeError(w, r, "A todo with this id already exists", http.StatusConflict)
+		return
+	case ErrMissingParent: // Deleted since it was looked up
+		writeError(w, r, "Not Found", http.StatusNotFound)
+		return
+	default:
+		writeStorageError(w, r, err)
+		return
+	}
+	setTodoETag(w, &todo)
+	writeTodo(w, r, http.StatusCreated, &todo)
+}
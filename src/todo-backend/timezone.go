@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+	_ "time/tzdata" // So zones load even where the system has no zoneinfo
+)
+
+type zoneKey struct{}
+
+// clientZone reads the time zone asked for with ?tz= or an X-Timezone header,
+// such as America/New_York, answering 400 if it isn't a known zone. Times in
+// the response are then shown in that zone; see localizeTodos.
+func clientZone(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("tz")
+		if name == "" {
+			name = r.Header.Get("X-Timezone")
+		}
+		if name != "" {
+			loc, err := time.LoadLocation(name)
+			if err != nil {
+				writeError(w, r, fmt.Sprintf("Unknown time zone %q", name), http.StatusBadRequest)
+				return
+			}
+			r = r.WithContext(context.WithValue(r.Context(), zoneKey{}, loc))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// localizeTodos moves the todos' times into the zone the client asked for, if
+// any. They are otherwise left in UTC.
+func localizeTodos(r *http.Request, todos ...*Todo) {
+	loc, ok := r.Context().Value(zoneKey{}).(*time.Location)
+	if !ok {
+		return
+	}
+	in := func(t *time.Time) *time.Time {
+		if t == nil {
+			return nil
+		}
+		local := t.In(loc) // A new value: clones share the pointed-to times
+		return &local
+	}
+	for _, todo := range todos {
+		todo.UpdatedAt = todo.UpdatedAt.In(loc)
+		todo.CompletedAt = in(todo.CompletedAt)
+		todo.DueDate = in(todo.DueDate)
+		todo.DeletedAt = in(todo.DeletedAt)
+		todo.ArchivedAt = in(todo.ArchivedAt)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// requestTiming accumulates how long a request spends in storage, for the
+// Server-Timing header.
+type requestTiming struct {
+	start time.Time
+
+	m       sync.Mutex
+	storage time.Duration
+}
+
+func (t *requestTiming) track(start time.Time) {
+	t.m.Lock()
+	t.storage += time.Since(start)
+	t.m.Unlock()
+}
+
+func (t *requestTiming) header() string {
+	t.m.Lock()
+	defer t.m.Unlock()
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	return fmt.Sprintf("db;dur=%.3f, total;dur=%.3f", ms(t.storage), ms(time.Since(t.start)))
+}
+
+type timingKey struct{}
+
+// timingResponseWriter adds the Server-Timing header as the response starts.
+type timingResponseWriter struct {
+	http.ResponseWriter
+	timing *requestTiming
+	wrote  bool
+}
+
+func (w *timingResponseWriter) WriteHeader(status int) {
+	if !w.wrote {
+		w.wrote = true
+		w.Header().Set("Server-Timing", w.timing.header())
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *timingResponseWriter) Write(b []byte) (int, error) {
+	if !w.wrote {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *timingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func serverTiming(next http.Handler) http.Handler {
+	if !*serverTimingHeader {
+		return next
+	}
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		timing := &requestTiming{start: time.Now()}
+		r = r.WithContext(context.WithValue(r.Context(), timingKey{}, timing))
+		next.ServeHTTP(&timingResponseWriter{ResponseWriter: w, timing: timing}, r)
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+// storageFor returns the TodoService handlers should use for r, which logs
+// storage failures with the request id, warns of slow calls with
+// -slow-query-threshold and records time spent in storage when Server-Timing
+// is enabled.
+func storageFor(r *http.Request) TodoService {
+	svc := TodoSvc
+	if *slowQueryThreshold > 0 {
+		svc = &slowTodoService{svc, *slowQueryThreshold, requestId(r.Context())}
+	}
+	if timing, ok := r.Context().Value(timingKey{}).(*requestTiming); ok {
+		svc = &timedTodoService{svc, timing}
+	}
+	return &loggedTodoService{svc, requestId(r.Context())}
+}
+
+type timedTodoService struct {
+	svc    TodoService
+	timing *requestTiming
+}
+
+func (t *timedTodoService) GetAll() ([]*Todo, error) {
+	defer t.timing.track(time.Now())
+	return t.svc.GetAll()
+}
+
+func (t *timedTodoService) Get(id int) (*Todo, error) {
+	defer t.timing.track(time.Now())
+	return t.svc.Get(id)
+}
+
+func (t *timedTodoService) GetMany(ids []int) ([]*Todo, error) {
+	defer t.timing.track(time.Now())
+	return t.svc.GetMany(ids)
+}
+
+func (t *timedTodoService) GetByTag(tag string) ([]*Todo, error) {
+	defer t.timing.track(time.Now())
+	return t.svc.GetByTag(tag)
+}
+
+func (t *timedTodoService) GetChangedSince(since time.Time) ([]*Todo, error) {
+	defer t.timing.track(time.Now())
+	return t.svc.GetChangedSince(since)
+}
+
+func (t *timedTodoService) GetChangedAfterSeq(seq int64) ([]*Todo, error) {
+	defer t.timing.track(time.Now())
+	return t.svc.GetChangedAfterSeq(seq)
+}
+
+func (t *timedTodoService) Snapshot() ([]*Todo, error) {
+	defer t.timing.track(time.Now())
+	return t.svc.Snapshot()
+}
+
+func (t *timedTodoService) CollectionVersion() (uint64, error) {
+	defer t.timing.track(time.Now())
+	return t.svc.CollectionVersion()
+}
+
+func (t *timedTodoService) Count() (int, error) {
+	defer t.timing.track(time.Now())
+	return t.svc.Count()
+}
+
+func (t *timedTodoService) ExistsByTitle(title string, except int) (bool, error) {
+	defer t.timing.track(time.Now())
+	return t.svc.ExistsByTitle(title, except)
+}
+
+func (t *timedTodoService) Stats() (TodoStats, error) {
+	defer t.timing.track(time.Now())
+	return t.svc.Stats()
+}
+
+func (t *timedTodoService) Save(todo *Todo) error {
+	defer t.timing.track(time.Now())
+	return t.svc.Save(todo)
+}
+
+func (t *timedTodoService) Create(todo *Todo) error {
+	defer t.timing.track(time.Now())
+	return t.svc.Create(todo)
+}
+
+func (t *timedTodoService) Upsert(todo *Todo) (bool, error) {
+	defer t.timing.track(time.Now())
+	return t.svc.Upsert(todo)
+}
+
+func (t *timedTodoService) Reorder(ids []int, complete bool) ([]*Todo, error) {
+	defer t.timing.track(time.Now())
+	return t.svc.Reorder(ids, complete)
+}
+
+func (t *timedTodoService) RenormalizeOrder(minGap float64) (bool, error) {
+	defer t.timing.track(time.Now())
+	return t.svc.RenormalizeOrder(minGap)
+}
+
+func (t *timedTodoService) TagCounts() ([]TagCount, error) {
+	defer t.timing.track(time.Now())
+	return t.svc.TagCounts()
+}
+
+func (t *timedTodoService) TagSummaries() ([]TagSummary, error) {
+	defer t.timing.track(time.Now())
+	return t.svc.TagSummaries()
+}
+
+func (t *timedTodoService) Subtasks(id int) ([]*Todo, error) {
+	defer t.timing.track(time.Now())
+	return t.svc.Subtasks(id)
+}
+
+func (t *timedTodoService) DeleteAll() error {
+	defer t.timing.track(time.Now())
+	return t.svc.DeleteAll()
+}
+
+func (t *timedTodoService) ArchiveCompleted() (int, error) {
+	defer t.timing.track(time.Now())
+	return t.svc.ArchiveCompleted()
+}
+
+func (t *timedTodoService) Move(id, anchor int, after bool) (*Todo, bool, error) {
+	defer t.timing.track(time.Now())
+	return t.svc.Move(id, anchor, after)
+}
+
+func (t *timedTodoService) DeleteWhere(filter TodoFilter) (int, error) {
+	defer t.timing.track(time.Now())
+	return t.svc.DeleteWhere(filter)
+}
+
+func (t *timedTodoService) History(id, offset, limit int) ([]*Todo, int, error) {
+	defer t.timing.track(time.Now())
+	return t.svc.History(id, offset, limit)
+}
+
+func (t *timedTodoService) Delete(id int) error {
+	defer t.timing.track(time.Now())
+	return t.svc.Delete(id)
+}
+
+func (t *timedTodoService) Purge(before time.Time) (int, error) {
+	defer t.timing.track(time.Now())
+	return t.svc.Purge(before)
+}
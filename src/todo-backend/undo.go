@@ -0,0 +1,306 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+)
+
+// errNothingToUndo is returned by Undo when the history is empty.
+var errNothingToUndo = kindError(ErrConflict, "nothing to undo")
+
+// undoEntry is one recorded change: the ids of the todos it created and the
+// todos it replaced or deleted, as they were before.
+type undoEntry struct {
+	op       string
+	created  []int
+	replaced []*Todo
+}
+
+// undoableTodoService records the last few writes with the state they
+// replaced so Undo can revert them, newest first. The prior state is read
+// just before each write, so a concurrent write to the same todo can slip in
+// between; this is a convenience for mistakes, not a transaction log.
+// Renumbering orders isn't recorded since it doesn't change the sequence.
+type undoableTodoService struct {
+	TodoService
+	limit int
+
+	m       sync.Mutex
+	history []undoEntry
+}
+
+// Undoable is the storage's undo history, set up in main.
+var Undoable *undoableTodoService
+
+func (t *undoableTodoService) record(entry undoEntry) {
+	if t.limit <= 0 || (len(entry.created) == 0 && len(entry.replaced) == 0) {
+		return
+	}
+	t.m.Lock()
+	t.history = append(t.history, entry)
+	if len(t.history) > t.limit {
+		t.history = t.history[len(t.history)-t.limit:]
+	}
+	t.m.Unlock()
+}
+
+// before returns the stored todo with id, or nil if there is none or the
+// lookup fails, in which case the write just goes unrecorded.
+func (t *undoableTodoService) before(id int) *Todo {
+	if id == 0 {
+		return nil
+	}
+	todo, err := t.TodoService.Get(id)
+	if err != nil {
+		return nil
+	}
+	return todo
+}
+
+// replacing records a write to an existing todo, or the todo it created.
+func (t *undoableTodoService) replacing(op string, previous, todo *Todo) {
+	if previous != nil {
+		t.record(undoEntry{op: op, replaced: []*Todo{previous}})
+	} else {
+		t.record(undoEntry{op: op, created: []int{todo.Id}})
+	}
+}
+
+func (t *undoableTodoService) Save(todo *Todo) error {
+	previous := t.before(todo.Id)
+	err := t.TodoService.Save(todo)
+	if err == nil {
+		t.replacing("update", previous, todo)
+	}
+	return err
+}
+
+func (t *undoableTodoService) Create(todo *Todo) error {
+	err := t.TodoService.Create(todo)
+	if err == nil {
+		t.record(undoEntry{op: "create", created: []int{todo.Id}})
+	}
+	return err
+}
+
+func (t *undoableTodoService) Upsert(todo *Todo) (bool, error) {
+	previous := t.before(todo.Id)
+	created, err := t.TodoService.Upsert(todo)
+	if err == nil {
+		t.replacing("replace", previous, todo)
+	}
+	return created, err
+}
+
+func (t *undoableTodoService) Move(id, anchor int, after bool) (*Todo, bool, error) {
+	previous := t.before(id)
+	todo, moved, err := t.TodoService.Move(id, anchor, after)
+	if err == nil && moved && previous != nil {
+		t.record(undoEntry{op: "move", replaced: []*Todo{previous}})
+	}
+	return todo, moved, err
+}
+
+// Reorder records the todos whose order it changed.
+func (t *undoableTodoService) Reorder(ids []int, complete bool) ([]*Todo, error) {
+	previous := t.matching(func(*Todo) bool { return true })
+	todos, err := t.TodoService.Reorder(ids, complete)
+	if err != nil {
+		return todos, err
+	}
+	orders := make(map[int]float64, len(todos))
+	for _, todo := range todos {
+		orders[todo.Id] = todo.Order
+	}
+	replaced := previous[:0]
+	for _, todo := range previous {
+		if order, ok := orders[todo.Id]; ok && order != todo.Order {
+			replaced = append(replaced, todo)
+		}
+	}
+	t.record(undoEntry{op: "reorder", replaced: replaced})
+	return todos, nil
+}
+
+// matching reads the todos a bulk write is about to change.
+func (t *undoableTodoService) matching(match func(*Todo) bool) []*Todo {
+	todos, err := t.TodoService.GetAll()
+	if err != nil {
+		return nil
+	}
+	kept := todos[:0]
+	for _, todo := range todos {
+		if match(todo) {
+			kept = append(kept, todo)
+		}
+	}
+	return kept
+}
+
+// withSubtasks adds to the todos a delete is about to remove the subtasks it
+// takes with them, ordering parents ahead of their subtasks so Undo can put
+// them back.
+func (t *undoableTodoService) withSubtasks(todos []*Todo) []*Todo {
+	all, err := t.TodoService.GetAll()
+	if err != nil || len(todos) == 0 {
+		return todos
+	}
+	deleting := make(map[int]bool, len(todos))
+	for _, todo := range todos {
+		deleting[todo.Id] = true
+	}
+	for added := true; added; {
+		added = false
+		for _, todo := range all {
+			if todo.ParentId != nil && deleting[int(*todo.ParentId)] && !deleting[todo.Id] {
+				deleting[todo.Id] = true
+				todos = append(todos, todo)
+				added = true
+			}
+		}
+	}
+
+	ordered := make([]*Todo, 0, len(todos))
+	placed := make(map[int]bool, len(todos))
+	for len(ordered) < len(todos) {
+		before := len(ordered)
+		for _, todo := range todos {
+			if placed[todo.Id] {
+				continue
+			}
+			if todo.ParentId == nil || !deleting[int(*todo.ParentId)] || placed[int(*todo.ParentId)] {
+				ordered = append(ordered, todo)
+				placed[todo.Id] = true
+			}
+		}
+		if len(ordered) == before {
+			return todos // A cycle, which stores don't allow
+		}
+	}
+	return ordered
+}
+
+func (t *undoableTodoService) ArchiveCompleted() (int, error) {
+	previous := t.matching(func(todo *Todo) bool { return todo.Completed && !todo.Archived })
+	n, err := t.TodoService.ArchiveCompleted()
+	if err == nil && n > 0 {
+		t.record(undoEntry{op: "archive", replaced: previous})
+	}
+	return n, err
+}
+
+func (t *undoableTodoService) DeleteAll() error {
+	previous := t.matching(func(*Todo) bool { return true })
+	err := t.TodoService.DeleteAll()
+	if err == nil {
+		t.record(undoEntry{op: "delete", replaced: previous})
+	}
+	return err
+}
+
+func (t *undoableTodoService) DeleteWhere(filter TodoFilter) (int, error) {
+	previous := t.withSubtasks(t.matching(filter.Matches))
+	n, err := t.TodoService.DeleteWhere(filter)
+	if err == nil && n > 0 {
+		t.record(undoEntry{op: "delete", replaced: previous})
+	}
+	return n, err
+}
+
+func (t *undoableTodoService) Delete(id int) error {
+	var previous []*Todo
+	if todo := t.before(id); todo != nil {
+		previous = t.withSubtasks([]*Todo{todo})
+	}
+	err := t.TodoService.Delete(id)
+	if err == nil {
+		t.record(undoEntry{op: "delete", replaced: previous})
+	}
+	return err
+}
+
+// Undo reverts the most recent recorded change, deleting the todos it created
+// and putting back the ones it replaced, which get new versions. It returns
+// the change's name and the todos put back. The change leaves the history
+// even if reverting it fails part way.
+func (t *undoableTodoService) Undo() (string, []*Todo, error) {
+	t.m.Lock()
+	if len(t.history) == 0 {
+		t.m.Unlock()
+		return "", nil, errNothingToUndo
+	}
+	entry := t.history[len(t.history)-1]
+	t.history = t.history[:len(t.history)-1]
+	t.m.Unlock()
+
+	// These go to the wrapped store so the undo isn't itself recorded.
+	for _, id := range entry.created {
+		if err := t.TodoService.Delete(id); err != nil {
+			return entry.op, nil, err
+		}
+	}
+	restored := make([]*Todo, 0, len(entry.replaced))
+	for _, todo := range entry.replaced {
+		todo.Version = 0 // Whatever happened since, this is the undo
+		if _, err := t.TodoService.Upsert(todo); err != nil {
+			return entry.op, restored, err
+		}
+		restored = append(restored, todo)
+	}
+	return entry.op, restored, nil
+}
+
+// discard deletes todos that were saved as part of a write that then
+// failed, such as an import being rolled back. The deletes go to the wrapped
+// store and the todos' creation is dropped from the history, so the failed
+// write leaves nothing to undo. It returns the first delete that fails but
+// still tries the rest.
+func (t *undoableTodoService) discard(ids []int) error {
+	var first error
+	for _, id := range ids {
+		if err := t.TodoService.Delete(id); err != nil && first == nil {
+			first = err
+		}
+	}
+
+	discarded := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		discarded[id] = true
+	}
+	t.m.Lock()
+	kept := t.history[:0]
+	for _, entry := range t.history {
+		created := entry.created[:0:0]
+		for _, id := range entry.created {
+			if !discarded[id] {
+				created = append(created, id)
+			}
+		}
+		entry.created = created
+		if len(entry.created) > 0 || len(entry.replaced) > 0 {
+			kept = append(kept, entry)
+		}
+	}
+	t.history = kept
+	t.m.Unlock()
+	return first
+}
+
+// undoHandler serves POST /todos/undo, answering 409 if there is nothing to
+// undo.
+func undoHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, r, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	op, todos, err := Undoable.Undo()
+	if err != nil {
+		writeStorageError(w, r, err)
+		return
+	}
+	prepareTodos(r, todos...)
+	writeJson(w, struct {
+		Undone string  `json:"undone"`
+		Todos  []*Todo `json:"todos"`
+	}{op, todos})
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// A todo is checked against each todoCheck before it is saved. What happens
+// when one fails is its checkMode, set with -check-modes: the write is
+// rejected with a 422, or saved with a Warning header (and, in an envelope,
+// a "warnings" meta) saying what is wrong, or the check is skipped.
+
+type checkMode string
+
+const (
+	CheckReject checkMode = "reject"
+	CheckWarn   checkMode = "warn"
+	CheckIgnore checkMode = "ignore"
+)
+
+// todoCheck describes how a todo fails a check, or returns "" if it passes.
+type todoCheck struct {
+	name        string
+	defaultMode checkMode
+	problem     func(todo *Todo) string
+}
+
+var todoChecks = []todoCheck{
+	// Lengths are in runes so multi-byte characters count once
+	{"title-length", CheckReject, func(todo *Todo) string {
+		if n := utf8.RuneCountInString(todo.Title); n > *maxTitleLength {
+			return fmt.Sprintf("title is %d characters, the limit is %d", n, *maxTitleLength)
+		}
+		return ""
+	}},
+	{"notes-length", CheckReject, func(todo *Todo) string {
+		if n := utf8.RuneCountInString(todo.Notes); n > *maxNotesLength {
+			return fmt.Sprintf("notes are %d characters, the limit is %d", n, *maxNotesLength)
+		}
+		return ""
+	}},
+	{"meta-size", CheckReject, func(todo *Todo) string {
+		if todo.Meta == nil {
+			return ""
+		}
+		b, err := json.Marshal(todo.Meta)
+		if err != nil {
+			return "meta: " + err.Error()
+		}
+		if len(b) > *maxMetaSize {
+			return fmt.Sprintf("meta is %d bytes as JSON, the limit is %d", len(b), *maxMetaSize)
+		}
+		return ""
+	}},
+	{"past-due", CheckIgnore, func(todo *Todo) string {
+		if todo.DueDate != nil && !todo.Completed && todo.DueDate.Before(clock.Now()) {
+			return "dueDate is in the past"
+		}
+		return ""
+	}},
+}
+
+// checkModes has the mode of every check, from -check-modes over the
+// defaults.
+var checkModes map[string]checkMode
+
+// parseCheckModes reads -check-modes, a comma-separated list of check:mode,
+// over the checks' default modes.
+func parseCheckModes(list string) (map[string]checkMode, error) {
+	modes := make(map[string]checkMode, len(todoChecks))
+	for _, check := range todoChecks {
+		modes[check.name] = check.defaultMode
+	}
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, mode, _ := strings.Cut(item, ":")
+		if _, ok := modes[name]; !ok {
+			return nil, fmt.Errorf("unknown check %q", name)
+		}
+		switch checkMode(mode) {
+		case CheckReject, CheckWarn, CheckIgnore:
+			modes[name] = checkMode(mode)
+		default:
+			return nil, fmt.Errorf("invalid mode %q for %s: must be reject, warn or ignore", mode, name)
+		}
+	}
+	return modes, nil
+}
+
+// checkLimits returns an error for the first check a todo fails that is
+// rejected, or else describes the ones it fails that are warned about.
+func checkLimits(todo *Todo) ([]string, error) {
+	var warnings []string
+	for _, check := range todoChecks {
+		mode := checkModes[check.name]
+		if mode == CheckIgnore {
+			continue
+		}
+		problem := check.problem(todo)
+		switch {
+		case problem == "":
+		case mode == CheckReject:
+			return nil, invalidf("%s", problem)
+		default:
+			warnings = append(warnings, problem)
+		}
+	}
+	return warnings, nil
+}
+
+// addWarnings sends each warning in a Warning header (RFC 7234), with code
+// 299 as they persist.
+func addWarnings(w http.ResponseWriter, warnings []string) {
+	for _, warning := range warnings {
+		w.Header().Add("Warning", "299 - "+strconv.Quote(warning))
+	}
+	if len(warnings) > 0 {
+		w.Header().Add("Access-Control-Expose-Headers", "Warning")
+	}
+}
+
+// responseWarnings returns the warnings addWarnings has sent, as an envelope
+// meta, or nil if there are none.
+func responseWarnings(w http.ResponseWriter) envelopeMeta {
+	var warnings []string
+	for _, header := range w.Header().Values("Warning") {
+		if text, err := strconv.Unquote(strings.TrimPrefix(header, "299 - ")); err == nil {
+			warnings = append(warnings, text)
+		}
+	}
+	if warnings == nil {
+		return nil
+	}
+	return envelopeMeta{"warnings": warnings}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestTitleLengthCountsRunes(t *testing.T) {
+	defer func(limit int) { *maxTitleLength = limit }(*maxTitleLength)
+	*maxTitleLength = 6
+
+	tests := []struct {
+		name  string
+		title string
+		ok    bool
+	}{
+		{"ascii at the limit", "abcdef", true},
+		{"ascii over", "abcdefg", false},
+		{"emoji at the limit", strings.Repeat("😀", 6), true},
+		{"emoji over", strings.Repeat("😀", 7), false},
+		// A flag is two regional indicator runes
+		{"flags at the limit", "🇯🇵🇫🇷🇧🇷", true},
+		{"flags over", "🇯🇵🇫🇷🇧🇷!", false},
+		// e and a combining acute accent are two runes
+		{"combining at the limit", "e\u0301e\u0301e\u0301", true},
+		{"combining over", "e\u0301e\u0301e\u0301x", false},
+		// Precomposed letters are one rune
+		{"precomposed at the limit", "\u00f1\u00e9\u00fc\u00e7\u00e5\u00f8", true},
+		{"precomposed over", "\u00f1\u00e9\u00fc\u00e7\u00e5\u00f8!", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := checkLimits(&Todo{Title: tt.title})
+			if tt.ok && err != nil {
+				t.Fatalf("%q (%d bytes) rejected: %v", tt.title, len(tt.title), err)
+			}
+			if !tt.ok && !errors.Is(err, ErrValidation) {
+				t.Fatalf("%q accepted, want a validation error", tt.title)
+			}
+		})
+	}
+}